@@ -0,0 +1,80 @@
+/*
+Copyright © 2021 Aaron Romeo caduceus@aaronromeo.com
+
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	internal "aaronromeo/mailboxorg/caduceus/internal"
+
+	"github.com/spf13/cobra"
+)
+
+// attachmentsCmd represents the attachments command
+var attachmentsCmd = &cobra.Command{
+	Use:   "attachments",
+	Short: "Work with message attachments",
+	Long:  `Work with message attachments`,
+}
+
+var attachmentsExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Download the attachments of the matching messages",
+	Long: `Download the attachments of the messages matching a search query into a directory.
+Identical attachments are written once, other name clashes get a counter. A manifest.json
+in the directory records the message, sender, date, filename and sha256 of each attachment.
+With --label, every message in the manifest is labelled, including the ones exported by
+an earlier or interrupted run, so a later migration can trash them.
+Usage:
+attachments export --query "larger:5M older_than:2y" --dir backup --label Exported`,
+	Run: runAttachmentsExport,
+}
+
+var FlagAttachmentsQuery string
+var FlagAttachmentsDir string
+var FlagAttachmentsLabel string
+
+func runAttachmentsExport(cmd *cobra.Command, args []string) {
+	if FlagAttachmentsQuery == "" {
+		fmt.Println("A --query is required")
+		os.Exit(1)
+	}
+
+	entries, exportErr := internal.ExportAttachments(FlagAttachmentsQuery, FlagAttachmentsDir)
+
+	messageIds := map[string]bool{}
+	for _, entry := range entries {
+		messageIds[entry.MessageId] = true
+	}
+	fmt.Printf("Exported %d attachments from %d messages to %s\n", len(entries), len(messageIds), FlagAttachmentsDir)
+
+	// Every message in the manifest is labelled, so the messages exported before an
+	// interruption are labelled too, by this run or the rerun
+	if FlagAttachmentsLabel != "" {
+		label, err := internal.FindOrCreateUserLabel(FlagAttachmentsLabel)
+		if err != nil {
+			panic(err)
+		}
+		labelled, err := internal.LabelExportedMessages(FlagAttachmentsDir, label)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("Labelled %d messages %s\n", labelled, label.Name)
+	}
+
+	if exportErr != nil {
+		panic(exportErr)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(attachmentsCmd)
+	attachmentsCmd.AddCommand(attachmentsExportCmd)
+
+	attachmentsExportCmd.Flags().StringVarP(&FlagAttachmentsQuery, "query", "q", "", "Search query selecting the messages")
+	attachmentsExportCmd.Flags().StringVarP(&FlagAttachmentsDir, "dir", "d", "attachments", "Directory to write the attachments to")
+	attachmentsExportCmd.Flags().StringVarP(&FlagAttachmentsLabel, "label", "l", "", "Label the exported messages with this label name")
+}
@@ -0,0 +1,109 @@
+/*
+Copyright © 2021 Aaron Romeo caduceus@aaronromeo.com
+
+*/
+package cmd
+
+import (
+	"fmt"
+
+	internal "aaronromeo/mailboxorg/caduceus/internal"
+
+	"github.com/spf13/cobra"
+)
+
+// diffCmd represents the diff command
+var diffCmd = &cobra.Command{
+	Use:   "diff [from] [to]",
+	Short: "Show the label and filter changes between two snapshots",
+	Long: `Show the labels and filters added, removed and changed between two snapshots.
+A snapshot is the name of a folder in 'data/snapshots', 'latest' or 'live'.
+Usage:
+diff                        (latest snapshot against live)
+diff 20220107-213500.123    (snapshot against live)
+diff 20220107-213500.123 latest
+diff --since-last-migrate   (changes made in the web UI since the last migrate)`,
+	Args: cobra.MaximumNArgs(2),
+	Run:  runDiff,
+}
+
+var FlagSinceLastMigrate bool
+
+func runDiff(cmd *cobra.Command, args []string) {
+	from := internal.LatestSnapshot
+	to := internal.LiveSnapshot
+
+	if FlagSinceLastMigrate {
+		var err error
+		from, err = internal.LastMigrateSnapshot()
+		if err != nil {
+			panic(err)
+		}
+	}
+	if len(args) > 0 {
+		from = args[0]
+	}
+	if len(args) > 1 {
+		to = args[1]
+	}
+
+	fromState, err := internal.LoadAccountState(from)
+	if err != nil {
+		panic(err)
+	}
+	toState, err := internal.LoadAccountState(to)
+	if err != nil {
+		panic(err)
+	}
+
+	labelNames := func(labelIds []string) string {
+		names := map[string]string{}
+		for _, state := range []*internal.CadAccountState{fromState, toState} {
+			for _, label := range state.Labels {
+				names[label.Id] = label.Name
+			}
+		}
+		return joinLabelNames(labelIds, names)
+	}
+	describeFilter := func(filter internal.CadFilter) string {
+		return fmt.Sprintf(
+			"%s (Add: %s Remove: %s)",
+			internal.CriteriaQuery(*filter.Criteria),
+			labelNames(filter.Action.AddLabelIds),
+			labelNames(filter.Action.RemoveLabelIds),
+		)
+	}
+
+	diff := internal.DiffAccountStates(fromState, toState)
+	fmt.Printf("Comparing %s with %s\n", fromState.Name, toState.Name)
+
+	fmt.Println("Labels")
+	for _, label := range diff.AddedLabels {
+		fmt.Printf("\t+ %s\n", label.Name)
+	}
+	for _, label := range diff.RemovedLabels {
+		fmt.Printf("\t- %s\n", label.Name)
+	}
+	for _, change := range diff.ChangedLabels {
+		for _, description := range change.Changes {
+			fmt.Printf("\t~ %s: %s\n", change.Label.Name, description)
+		}
+	}
+
+	fmt.Println("Filters")
+	for _, filter := range diff.AddedFilters {
+		fmt.Printf("\t+ %s\n", describeFilter(filter))
+	}
+	for _, filter := range diff.RemovedFilters {
+		fmt.Printf("\t- %s\n", describeFilter(filter))
+	}
+	for _, change := range diff.ChangedFilters {
+		fmt.Printf("\t~ %s\n\t  -> %s\n", describeFilter(change.From), describeFilter(change.To))
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(diffCmd)
+
+	diffCmd.Flags().BoolVar(&FlagSinceLastMigrate, "since-last-migrate", false, "Compare the snapshot taken after the last migrate run")
+}
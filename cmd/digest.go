@@ -0,0 +1,75 @@
+/*
+Copyright © 2021 Aaron Romeo caduceus@aaronromeo.com
+
+*/
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	internal "aaronromeo/mailboxorg/caduceus/internal"
+
+	"github.com/spf13/cobra"
+)
+
+// Number of days of inbox mail searched for unsubscribe suggestions
+const unsubscribeWindowDays int = 120
+
+// digestCmd represents the digest command
+var digestCmd = &cobra.Command{
+	Use:   "digest",
+	Short: "Email an HTML digest of unsubscribe suggestions",
+	Long: `Run the doctor's unsubscribe analysis and email the result as an HTML digest to
+the account owner. Each sender is listed with sample subjects, the number of messages,
+the unsubscribe link and a proposed filter.
+Usage:
+digest                     (email the digest)
+digest --out digest.html   (write the digest to a file instead)`,
+	Run: runDigest,
+}
+
+var FlagDigestOut string
+var FlagDigestDays int
+
+func runDigest(cmd *cobra.Command, args []string) {
+	if err := SendDigest(FlagDigestDays, FlagDigestOut); err != nil {
+		panic(err)
+	}
+}
+
+// SendDigest emails the unsubscribe digest, or writes it to out when it is set
+func SendDigest(days int, out string) error {
+	since := time.Now().AddDate(0, 0, -days).UTC()
+	suggestions, err := internal.GetMessageCriteriaForUnsubscribe(since)
+	if err != nil {
+		return err
+	}
+
+	html, err := internal.RenderDigest(internal.BuildDigest(suggestions, since))
+	if err != nil {
+		return err
+	}
+
+	if out != "" {
+		if err := ioutil.WriteFile(out, html, 0664); err != nil {
+			return err
+		}
+		fmt.Printf("Digest written to %s\n", out)
+		return nil
+	}
+
+	if err := internal.SendDigest(html); err != nil {
+		return err
+	}
+	fmt.Printf("Digest sent with %d suggestions\n", len(suggestions))
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(digestCmd)
+
+	digestCmd.Flags().StringVarP(&FlagDigestOut, "out", "o", "", "Write the digest to this file instead of emailing it")
+	digestCmd.Flags().IntVarP(&FlagDigestDays, "days", "n", unsubscribeWindowDays, "Number of days of inbox mail to analyse")
+}
@@ -36,11 +36,17 @@ const no string = "No"
 const end string = "End suggestions"
 const neverImportant string = "Never mark it as important"
 const alwaysImportant string = "Always mark it as important"
+const recreateLabel string = "Recreate the label"
+const removeLabel string = "Remove the label from the filter"
+const unsubscribe string = "Unsubscribe"
 
 var FlagSuggestions bool
 var FlagDirect bool
 var FlagFilterMaintenance bool
 var FlagFetch bool
+var FlagDoctorDeadDays int
+var FlagDoctorSyncMessages bool
+var FlagUnsubscribeDryRun bool
 
 func runDoctor(cmd *cobra.Command, args []string) {
 	updateLabelsResult := yes
@@ -88,10 +94,19 @@ func runDoctor(cmd *cobra.Command, args []string) {
 		FetchFilters()
 	}
 
+	if updateLabelsResult == yes || updateFiltersResult == yes {
+		SnapshotAccount(false)
+	}
+
 	if FlagSuggestions || FlagFilterMaintenance {
 		fmt.Println("Analyzing results...")
 	}
 
+	// The first sync fetches the metadata of every message, so it is only done on request
+	if FlagDoctorSyncMessages {
+		SyncMessages(false)
+	}
+
 	if FlagSuggestions && !FlagDirect {
 		interactiveSuggestions()
 	}
@@ -105,21 +120,39 @@ func runDoctor(cmd *cobra.Command, args []string) {
 			panic(err)
 		}
 
+		scope := internal.CadBackfillScope{
+			Mailbox: internal.BackfillScopeInbox,
+			Query:   "has:nouserlabels",
+		}
 		for _, archiveFilter := range filters {
+			if archiveFilter.Criteria == nil {
+				continue
+			}
 			fmt.Printf("\tSearching for filter ID %s", archiveFilter.Id)
-			ids, _ := internal.GetMessageIDsInInboxByFilterCriteria(&archiveFilter)
+			ids, err := internal.BackfillMessageIds(archiveFilter, scope)
+			if err != nil {
+				fmt.Printf("Maintenance failed %v\n", err)
+				panic(err)
+			}
 
 			if len(ids) != 0 {
 				fmt.Print("\t\tFound results\n")
 
-				operation := internal.UpdateMessagesMigration
-				note := fmt.Sprintf("Archived message identified by the doctor (filter %s)", archiveFilter.Id)
+				operation := internal.ApplyFilterMigration
+				note := fmt.Sprintf("Archived message identified by the doctor (filter %s, %d messages expected)", archiveFilter.Id, len(ids))
+				// The criteria and action are kept so the migration does not depend on the
+				// filter still existing, the id only checks that it was not removed since
+				filterId := archiveFilter.Id
+				filterCriteria := *archiveFilter.Criteria
+				filterAction := *archiveFilter.Action
+				filterScope := scope
 				archiveMigration := internal.CadRawMigration{
 					Operation: &operation,
-					Details: internal.CadUpdateMessagesMigration{
-						MessageIds:     &ids,
-						RemoveLabelIds: &archiveFilter.Action.RemoveLabelIds,
-						AddLabelIds:    &archiveFilter.Action.AddLabelIds,
+					Details: internal.CadApplyFilterMigration{
+						Id:       &filterId,
+						Criteria: &filterCriteria,
+						Action:   &filterAction,
+						Scope:    &filterScope,
 					},
 					Note: &note,
 				}
@@ -144,6 +177,21 @@ func interactiveSuggestions() {
 		panic(err)
 	}
 
+	brokenFilterCadMigrations, err := brokenFilterMigrations()
+	if err != nil {
+		panic(err)
+	}
+
+	overlapFilterCadMigrations, err := overlapFilterMigrations()
+	if err != nil {
+		panic(err)
+	}
+
+	deadFilterCadMigrations, err := deadFilterMigrations()
+	if err != nil {
+		panic(err)
+	}
+
 	unsubscribeCadMigrations, err := unsubscribeMigrations()
 	if err != nil {
 		panic(err)
@@ -152,6 +200,9 @@ func interactiveSuggestions() {
 	totalmigs := []internal.CadRawMigration{}
 	totalmigs = append(emptyLabelCadMigrations, unsubscribeCadMigrations...)
 	totalmigs = append(totalmigs, duplicateFilterCadMigrations...)
+	totalmigs = append(totalmigs, brokenFilterCadMigrations...)
+	totalmigs = append(totalmigs, overlapFilterCadMigrations...)
+	totalmigs = append(totalmigs, deadFilterCadMigrations...)
 	internal.CreateMigrationFile(&totalmigs)
 }
 
@@ -208,6 +259,148 @@ func duplicateFilterMigrations() ([]internal.CadRawMigration, error) {
 	return migrations, nil
 }
 
+func brokenFilterMigrations() ([]internal.CadRawMigration, error) {
+	brokenFilters, err := internal.BrokenFilters()
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := []internal.CadRawMigration{}
+	for _, brokenFilter := range brokenFilters {
+		for _, missingLabelId := range brokenFilter.MissingLabelIds {
+			prompt := promptui.Select{
+				Label: fmt.Sprintf(
+					"Filter %s references the missing label %s",
+					internal.CriteriaKey(*brokenFilter.Filter.Criteria),
+					missingLabelId,
+				),
+				Items: []string{
+					recreateLabel,
+					removeLabel,
+					skip,
+					end,
+				},
+			}
+
+			_, result, err := prompt.Run()
+
+			if err != nil {
+				return nil, err
+			}
+
+			if result == end {
+				return migrations, nil
+			} else if result == skip {
+				continue
+			}
+
+			operation := internal.RepairFilterMigration
+			note := fmt.Sprintf("Filter referencing missing label %s identified by the doctor", missingLabelId)
+			filterId := brokenFilter.Filter.Id
+			labelId := missingLabelId
+			details := internal.CadRepairFilterMigration{
+				Id:      &filterId,
+				LabelId: &labelId,
+			}
+
+			if result == recreateLabel {
+				namePrompt := promptui.Prompt{
+					Label: "Label name",
+				}
+
+				name, err := namePrompt.Run()
+
+				if err != nil {
+					fmt.Printf("Prompt failed %v\n", err)
+					return migrations, err
+				}
+				details.Name = &name
+			}
+
+			migrations = append(migrations, internal.CadRawMigration{
+				Operation: &operation,
+				Details:   details,
+				Note:      &note,
+			})
+		}
+	}
+	return migrations, nil
+}
+
+func overlapFilterMigrations() ([]internal.CadRawMigration, error) {
+	relationships, err := internal.AnalyzeFilterOverlaps()
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := []internal.CadRawMigration{}
+	for _, relationship := range relationships {
+		fmt.Printf("\n%s: %s\n", relationship.Kind, relationship.Explanation)
+		if relationship.Suggestion == nil {
+			continue
+		}
+
+		prompt := promptui.Select{
+			Label: fmt.Sprintf("Apply suggestion: %s", *relationship.Suggestion.Note),
+			Items: []string{
+				yes,
+				no,
+				end,
+			},
+		}
+
+		_, result, err := prompt.Run()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if result == yes {
+			migrations = append(migrations, *relationship.Suggestion)
+		} else if result == end {
+			return migrations, nil
+		}
+	}
+	return migrations, nil
+}
+
+func deadFilterMigrations() ([]internal.CadRawMigration, error) {
+	if FlagDoctorDeadDays <= 0 {
+		return []internal.CadRawMigration{}, nil
+	}
+
+	fmt.Printf("Searching for filters without matches in the last %d days...\n", FlagDoctorDeadDays)
+	filters, err := internal.DeadFilters(FlagDoctorDeadDays)
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := []internal.CadRawMigration{}
+	for i, deadFilterMigration := range internal.DeadFilterMigrations(filters, FlagDoctorDeadDays) {
+		prompt := promptui.Select{
+			Label: fmt.Sprintf("Delete dead filter %s", internal.CriteriaKey(*filters[i].Criteria)),
+			Items: []string{
+				yes,
+				no,
+				end,
+			},
+		}
+
+		_, result, err := prompt.Run()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if result == yes {
+			migrations = append(migrations, deadFilterMigration)
+		} else if result == end {
+			return migrations, nil
+		}
+	}
+	return migrations, nil
+}
+
 func emptyLabelMigrations() ([]internal.CadRawMigration, error) {
 	localLabels, err := internal.ReadLocalLabels()
 	if err != nil {
@@ -229,22 +422,38 @@ func emptyLabelMigrations() ([]internal.CadRawMigration, error) {
 		}
 	}
 
+	localFilters, err := internal.ReadLocalFilters()
+	if err != nil {
+		log.Printf("Unable to read local filters: %v", err)
+		return nil, err
+	}
+
 	emptyLabelRawMigrations := []internal.CadRawMigration{}
 	for _, label := range emptyLabels {
 		if len(nestedLabelLookup[label.Name]) == 1 {
 			operation := internal.DeleteLabelMigration
 			note := fmt.Sprintf("%s: Empty Label identified by the doctor", label.Name)
 			labelId := label.Id
+			details := internal.CadDeleteLabelMigration{
+				Id: &labelId,
+			}
+			promptLabel := fmt.Sprintf("Delete empty label %s", label.Name)
+
+			referencing := internal.FiltersReferencingLabel(localFilters, label.Id)
+			if len(referencing) > 0 {
+				cascade := true
+				details.Cascade = &cascade
+				promptLabel = fmt.Sprintf("%s and remove it from %d filters", promptLabel, len(referencing))
+			}
+
 			labelMigration := internal.CadRawMigration{
 				Operation: &operation,
-				Details: internal.CadDeleteLabelMigration{
-					Id: &labelId,
-				},
-				Note: &note,
+				Details:   details,
+				Note:      &note,
 			}
 
 			prompt := promptui.Select{
-				Label: fmt.Sprintf("Delete empty label %s", label.Name),
+				Label: promptLabel,
 				Items: []string{
 					yes,
 					no,
@@ -272,11 +481,12 @@ func emptyLabelMigrations() ([]internal.CadRawMigration, error) {
 
 func unsubscribeMigrations() ([]internal.CadRawMigration, error) {
 	returnMigrations := []internal.CadRawMigration{}
-	criteriaAndSampleMessages, err := internal.GetMessageCriteriaForUnsubscribe(time.Now().Add(-time.Hour * 24 * 120).UTC())
+	criteriaAndSampleMessages, err := internal.GetMessageCriteriaForUnsubscribe(time.Now().AddDate(0, 0, -unsubscribeWindowDays).UTC())
 	if err != nil {
 		return nil, err
 	}
 	unsubscribeMigrations := []internal.CadRawMigration{}
+	unsubscriber := internal.NewUnsubscriber(FlagUnsubscribeDryRun)
 
 	for _, cAndSM := range criteriaAndSampleMessages {
 		criteria := *cAndSM.Criteria
@@ -313,13 +523,15 @@ func unsubscribeMigrations() ([]internal.CadRawMigration, error) {
 		}
 		fmt.Printf("\tFrom: %s\n\tTo: %s\n\tSample subject: %s\n", from, to, subject)
 
+		actions := []string{create_filter, skip, end}
+		listUnsubscribe := internal.ListUnsubscribeFromHeaders(cAndSM.SampleMessage.Payload.Headers)
+		if listUnsubscribe.CanUnsubscribe() {
+			actions = []string{unsubscribe, create_filter, skip, end}
+		}
+
 		prompt := promptui.Select{
 			Label: "Select action",
-			Items: []string{
-				create_filter,
-				skip,
-				end,
-			},
+			Items: actions,
 		}
 
 		_, result, err := prompt.Run()
@@ -328,6 +540,15 @@ func unsubscribeMigrations() ([]internal.CadRawMigration, error) {
 			return returnMigrations, err
 		}
 
+		if result == unsubscribe {
+			record, err := unsubscriber.Unsubscribe(from, listUnsubscribe)
+			if err != nil {
+				fmt.Printf("Unsubscribe failed %v\n", err)
+			} else {
+				fmt.Printf("\tUnsubscribed (%s) with %s %s\n", record.Status, record.Method, record.Target)
+			}
+		}
+
 		if result == create_filter {
 			selectedAction := internal.CadAction{}
 
@@ -458,4 +679,7 @@ func init() {
 	doctorCmd.Flags().BoolVarP(&FlagFetch, "fetch", "f", true, "Fetch the labels and filters (only used in direct mode)")
 	doctorCmd.Flags().BoolVarP(&FlagSuggestions, "suggestions", "s", true, "Generate filter and label suggestions if in interactive mode")
 	doctorCmd.Flags().BoolVarP(&FlagFilterMaintenance, "maintenance", "m", false, "Generate message cleanup based on existing filters")
+	doctorCmd.Flags().IntVarP(&FlagDoctorDeadDays, "dead-days", "n", 0, "Suggest deleting filters without matches in this many days, eg 365 (0 to skip)")
+	doctorCmd.Flags().BoolVar(&FlagDoctorSyncMessages, "sync-messages", false, "Sync the local message store before the analysis, the first sync fetches every message")
+	doctorCmd.Flags().BoolVar(&FlagUnsubscribeDryRun, "unsubscribe-dry-run", false, "Show the unsubscribes instead of performing them")
 }
@@ -0,0 +1,86 @@
+/*
+Copyright © 2021 Aaron Romeo caduceus@aaronromeo.com
+
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	internal "aaronromeo/mailboxorg/caduceus/internal"
+
+	"github.com/spf13/cobra"
+)
+
+// exportCmd represents the export command
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Back up messages to an mbox file or a directory of .eml files",
+	Long: `Back up the raw messages with a label or matching a search query to an mbox file or
+to a directory with one .eml file per message. Each message gets an X-Gmail-Labels header
+listing its labels so the archive can be imported again.
+A checkpoint next to the export records the exported messages, rerunning the same
+command resumes an interrupted export.
+Usage:
+export --label Notifications --out notifications.mbox
+export --query "older_than:5y" --format eml-dir --out old-mail`,
+	Run: runExport,
+}
+
+var FlagExportQuery string
+var FlagExportLabel string
+var FlagExportFormat string
+var FlagExportOut string
+
+func runExport(cmd *cobra.Command, args []string) {
+	if FlagExportQuery == "" && FlagExportLabel == "" {
+		fmt.Println("A --query or a --label is required")
+		os.Exit(1)
+	}
+
+	labels := []*internal.CadLabel{}
+	if FlagExportLabel != "" {
+		localLabels, err := internal.ReadLocalLabels()
+		if err != nil {
+			panic(err)
+		}
+		for i, label := range localLabels {
+			if strings.EqualFold(label.Name, FlagExportLabel) {
+				labels = append(labels, &localLabels[i])
+			}
+		}
+		if len(labels) == 0 {
+			fmt.Printf("Unable to find the label: %s\n", FlagExportLabel)
+			os.Exit(1)
+		}
+	}
+	var query *string
+	if FlagExportQuery != "" {
+		query = &FlagExportQuery
+	}
+
+	out := FlagExportOut
+	if out == "" {
+		out = "export"
+		if FlagExportFormat == internal.ExportFormatMbox {
+			out = "export.mbox"
+		}
+	}
+
+	count, err := internal.ExportMessages(labels, query, FlagExportFormat, out)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("Exported %d messages to %s\n", count, out)
+}
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+
+	exportCmd.Flags().StringVarP(&FlagExportQuery, "query", "q", "", "Search query selecting the messages")
+	exportCmd.Flags().StringVarP(&FlagExportLabel, "label", "l", "", "Label name selecting the messages")
+	exportCmd.Flags().StringVarP(&FlagExportFormat, "format", "f", internal.ExportFormatMbox, "Archive format (mbox|eml-dir)")
+	exportCmd.Flags().StringVarP(&FlagExportOut, "out", "o", "", "Mbox file or directory to write, export.mbox or export by default")
+}
@@ -15,8 +15,9 @@ import (
 
 const labelsArg string = "labels"
 const filtersArg string = "filters"
+const forwardingArg string = "forwarding"
 
-var validArgs = []string{labelsArg, filtersArg, "all"}
+var validArgs = []string{labelsArg, filtersArg, forwardingArg, "all"}
 
 // fetchCmd represents the fetch command
 var fetchCmd = &cobra.Command{
@@ -26,7 +27,8 @@ var fetchCmd = &cobra.Command{
 fetch
 fetch all
 fetch labels
-fetch filters`,
+fetch filters
+fetch forwarding`,
 	ValidArgs: validArgs,
 	Args: func(cmd *cobra.Command, args []string) error {
 		if len(args) == 0 {
@@ -51,10 +53,14 @@ func fetchLabelsAndFilters(cmd *cobra.Command, args []string) {
 		FetchLabels()
 	case filtersArg:
 		FetchFilters()
+	case forwardingArg:
+		FetchForwardingAddresses()
 	default:
 		FetchLabels()
 		FetchFilters()
+		FetchForwardingAddresses()
 	}
+	SnapshotAccount(false)
 }
 
 func FetchLabels() {
@@ -83,6 +89,30 @@ func FetchFilters() {
 	fmt.Printf("\tFound %d filters\n", len(filters))
 }
 
+func SnapshotAccount(afterMigrate bool) {
+	name, err := internal.TakeSnapshot(afterMigrate)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("Saved snapshot %s\n", name)
+}
+
+func FetchForwardingAddresses() {
+	fmt.Println("Fetching forwarding addresses...")
+	addresses, err := internal.GetForwardingAddresses()
+	if err != nil {
+		panic(err)
+	}
+	err = internal.SaveLocalForwardingAddresses(addresses)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("\tFound %d forwarding addresses\n", len(addresses))
+	for _, address := range addresses {
+		fmt.Printf("\t\t%s (%s)\n", address.ForwardingEmail, address.VerificationStatus)
+	}
+}
+
 func contains(s []string, str string) bool {
 	for _, v := range validArgs {
 		if v == str {
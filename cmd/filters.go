@@ -0,0 +1,316 @@
+/*
+Copyright © 2021 Aaron Romeo caduceus@aaronromeo.com
+
+*/
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	internal "aaronromeo/mailboxorg/caduceus/internal"
+
+	"github.com/manifoldco/promptui"
+	"github.com/spf13/cobra"
+)
+
+// filtersCmd represents the filters command
+var filtersCmd = &cobra.Command{
+	Use:   "filters",
+	Short: "Inspect and maintain Gmail filters",
+	Long:  `Inspect and maintain the Gmail filters cached in the 'data' folder`,
+}
+
+// filtersTestCmd represents the filters test command
+var filtersTestCmd = &cobra.Command{
+	Use:   "test <eml file|message id>",
+	Short: "List the filters that match a message",
+	Long: `List the local filters that match a message and the label changes they would cause.
+
+The message is either a path to an .eml file or a Gmail message ID.
+Usage:
+filters test message.eml
+filters test 17e2c4a3b2f1d0e9`,
+	Args: cobra.ExactArgs(1),
+	Run:  testFilters,
+}
+
+// filtersCompactCmd represents the filters compact command
+var filtersCompactCmd = &cobra.Command{
+	Use:   "compact",
+	Short: "Merge sender filters that share an action",
+	Long: `Merge the filters that only match on the sender and share the same action into
+from:(a OR b OR c) filters, and write the migration to the 'migrations' folder`,
+	Run: compactFilters,
+}
+
+// filtersDeadCmd represents the filters dead command
+var filtersDeadCmd = &cobra.Command{
+	Use:   "dead",
+	Short: "Find filters that have not matched any recent mail",
+	Long: `Search Gmail for the mail each filter would have matched over the last days and
+write a migration deleting the filters without any matches to the 'migrations' folder`,
+	Run: deadFilters,
+}
+
+var FlagDeadDays int
+
+// filtersBackfillCmd represents the filters backfill command
+var filtersBackfillCmd = &cobra.Command{
+	Use:   "backfill [filter ids]",
+	Short: "Apply filters to existing mail",
+	Long: `Apply the full action of the selected filters to the existing mail matching their criteria.
+Without filter ids the filter is picked from the local filters.
+Usage:
+filters backfill
+filters backfill ANe1BmgCsraTcxmqDmmFsU27_GhBtX1h5_7F3g --scope all --after 2021-01-01`,
+	Run: backfillFilters,
+}
+
+var FlagBackfillScope string
+var FlagBackfillAfter string
+var FlagBackfillBefore string
+var FlagBackfillForward bool
+var FlagBackfillYes bool
+
+func testFilters(cmd *cobra.Command, args []string) {
+	facts, err := internal.ReadMessageFacts(args[0])
+	if err != nil {
+		panic(err)
+	}
+
+	filters, err := internal.FiltersMatchingMessage(facts)
+	if err != nil {
+		panic(err)
+	}
+
+	labelNames, err := labelNameLookup()
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Printf("Message %s\n\tFrom: %s\n\tTo: %s\n\tSubject: %s\n", facts.Id, facts.From, facts.To, facts.Subject)
+	if len(filters) == 0 {
+		fmt.Println("No filters match this message")
+		return
+	}
+
+	fmt.Printf("Found %d matching filters\n", len(filters))
+	for _, filter := range filters {
+		fmt.Printf("\t%s %s\n", filter.Id, internal.CriteriaKey(*filter.Criteria))
+		fmt.Printf("\t\tAdd: %s\n", labelNames(filter.Action.AddLabelIds))
+		fmt.Printf("\t\tRemove: %s\n", labelNames(filter.Action.RemoveLabelIds))
+		if filter.Action.Forward != "" {
+			fmt.Printf("\t\tForward: %s\n", filter.Action.Forward)
+		}
+	}
+
+	changes := internal.CombinedLabelChanges(filters)
+	fmt.Println("Combined label changes")
+	fmt.Printf("\tAdd: %s\n", labelNames(changes.AddLabelIds))
+	fmt.Printf("\tRemove: %s\n", labelNames(changes.RemoveLabelIds))
+	if len(changes.Forwards) > 0 {
+		fmt.Printf("\tForward: %s\n", strings.Join(changes.Forwards, ", "))
+	}
+}
+
+func compactFilters(cmd *cobra.Command, args []string) {
+	compactions, err := internal.CompactFilters()
+	if err != nil {
+		panic(err)
+	}
+
+	if len(compactions) == 0 {
+		fmt.Println("No filters to compact")
+		return
+	}
+
+	labelNames, err := labelNameLookup()
+	if err != nil {
+		panic(err)
+	}
+
+	localFilters, err := internal.ReadLocalFilters()
+	if err != nil {
+		panic(err)
+	}
+
+	removed := 0
+	for _, compaction := range compactions {
+		fmt.Printf("Add: %s Remove: %s\n", labelNames(compaction.Action.AddLabelIds), labelNames(compaction.Action.RemoveLabelIds))
+		fmt.Printf("\t%d filters -> %d filters\n", len(compaction.FilterIds), len(compaction.Queries))
+		removed += len(compaction.FilterIds) - len(compaction.Queries)
+	}
+	fmt.Printf("Filter count: %d -> %d\n", len(localFilters), len(localFilters)-removed)
+
+	migrations := internal.CompactionMigrations(compactions)
+	err = internal.CreateMigrationFile(&migrations)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func deadFilters(cmd *cobra.Command, args []string) {
+	fmt.Printf("Searching for filters without matches in the last %d days...\n", FlagDeadDays)
+	filters, err := internal.DeadFilters(FlagDeadDays)
+	if err != nil {
+		panic(err)
+	}
+
+	if len(filters) == 0 {
+		fmt.Println("No dead filters found")
+		return
+	}
+
+	fmt.Printf("Found %d dead filters\n", len(filters))
+	for _, filter := range filters {
+		fmt.Printf("\t%s %s\n", filter.Id, internal.CriteriaKey(*filter.Criteria))
+	}
+
+	migrations := internal.DeadFilterMigrations(filters, FlagDeadDays)
+	err = internal.CreateMigrationFile(&migrations)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func backfillFilters(cmd *cobra.Command, args []string) {
+	localFilters, err := internal.ReadLocalFilters()
+	if err != nil {
+		panic(err)
+	}
+
+	selectedFilters := []internal.CadFilter{}
+	if len(args) == 0 {
+		items := []string{}
+		for _, filter := range localFilters {
+			items = append(items, internal.CriteriaQuery(*filter.Criteria))
+		}
+
+		prompt := promptui.Select{
+			Label: "Select the filter to backfill",
+			Items: items,
+			Size:  15,
+		}
+
+		i, _, err := prompt.Run()
+
+		if err != nil {
+			fmt.Printf("Prompt failed %v\n", err)
+			panic(err)
+		}
+		selectedFilters = append(selectedFilters, localFilters[i])
+	} else {
+		for _, id := range args {
+			found := false
+			for _, filter := range localFilters {
+				if filter.Id == id {
+					selectedFilters = append(selectedFilters, filter)
+					found = true
+					break
+				}
+			}
+			if !found {
+				panic(fmt.Errorf("unable to find the filter %s", id))
+			}
+		}
+	}
+
+	labelNames, err := labelNameLookup()
+	if err != nil {
+		panic(err)
+	}
+
+	scope := internal.CadBackfillScope{
+		Mailbox: FlagBackfillScope,
+		After:   FlagBackfillAfter,
+		Before:  FlagBackfillBefore,
+	}
+
+	fmt.Println("Searching for matching messages...")
+	messageIds := [][]string{}
+	for _, filter := range selectedFilters {
+		ids, err := internal.BackfillMessageIds(filter, scope)
+		if err != nil {
+			panic(err)
+		}
+		messageIds = append(messageIds, ids)
+
+		fmt.Printf("\t%s %s\n", filter.Id, internal.CriteriaQuery(*filter.Criteria))
+		fmt.Printf("\t\t%d messages\n", len(ids))
+		fmt.Printf("\t\tAdd: %s\n", labelNames(filter.Action.AddLabelIds))
+		fmt.Printf("\t\tRemove: %s\n", labelNames(filter.Action.RemoveLabelIds))
+		if filter.Action.Forward != "" && FlagBackfillForward {
+			fmt.Printf("\t\tForward: %s\n", filter.Action.Forward)
+		}
+	}
+
+	if !FlagBackfillYes {
+		prompt := promptui.Select{
+			Label: "Apply the filters to these messages?",
+			Items: []string{yes, no},
+		}
+
+		_, result, err := prompt.Run()
+
+		if err != nil {
+			fmt.Printf("Prompt failed %v\n", err)
+			panic(err)
+		}
+		if result != yes {
+			return
+		}
+	}
+
+	for i, filter := range selectedFilters {
+		fmt.Printf("Backfilling filter %s...\n", filter.Id)
+		err := internal.ApplyFilterAction(messageIds[i], *filter.Action, FlagBackfillForward)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+func labelNameLookup() (func([]string) string, error) {
+	localLabels, err := internal.ReadLocalLabels()
+	if err != nil {
+		return nil, err
+	}
+
+	labelmap := map[string]string{}
+	for _, label := range localLabels {
+		labelmap[label.Id] = label.Name
+	}
+
+	return func(labelIds []string) string {
+		return joinLabelNames(labelIds, labelmap)
+	}, nil
+}
+
+func joinLabelNames(labelIds []string, labelmap map[string]string) string {
+	names := []string{}
+	for _, labelId := range labelIds {
+		if name, ok := labelmap[labelId]; ok {
+			names = append(names, name)
+		} else {
+			names = append(names, labelId)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+func init() {
+	rootCmd.AddCommand(filtersCmd)
+	filtersCmd.AddCommand(filtersTestCmd)
+	filtersCmd.AddCommand(filtersCompactCmd)
+	filtersCmd.AddCommand(filtersDeadCmd)
+	filtersCmd.AddCommand(filtersBackfillCmd)
+
+	filtersDeadCmd.Flags().IntVarP(&FlagDeadDays, "days", "n", 365, "Number of days without matches before a filter is considered dead")
+
+	filtersBackfillCmd.Flags().StringVarP(&FlagBackfillScope, "scope", "s", internal.BackfillScopeInbox, "Mail to apply the filters to (inbox|all)")
+	filtersBackfillCmd.Flags().StringVar(&FlagBackfillAfter, "after", "", "Only apply to mail received after this date (YYYY-MM-DD)")
+	filtersBackfillCmd.Flags().StringVar(&FlagBackfillBefore, "before", "", "Only apply to mail received before this date (YYYY-MM-DD)")
+	filtersBackfillCmd.Flags().BoolVarP(&FlagBackfillForward, "forward", "f", false, "Also forward the messages when the filter forwards mail")
+	filtersBackfillCmd.Flags().BoolVarP(&FlagBackfillYes, "yes", "y", false, "Apply without asking for confirmation")
+}
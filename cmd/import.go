@@ -0,0 +1,51 @@
+/*
+Copyright © 2021 Aaron Romeo caduceus@aaronromeo.com
+
+*/
+package cmd
+
+import (
+	"fmt"
+
+	internal "aaronromeo/mailboxorg/caduceus/internal"
+
+	"github.com/spf13/cobra"
+)
+
+// importCmd represents the import command
+var importCmd = &cobra.Command{
+	Use:   "import <mbox|eml|dir>",
+	Short: "Import an mbox or .eml file or a directory of messages into Gmail",
+	Long: `Import the messages of an mbox or .eml file, or of the .eml and mbox files in a
+directory, into Gmail, keeping the date of their Date header.
+Messages are labelled from their X-Gmail-Labels header, as written by export or Google
+Takeout, or else from the folder holding them. Missing labels are created. Messages whose
+Message-ID is already in the mailbox are skipped, and messages which can not be parsed
+are logged and counted as failed.
+A checkpoint next to the source records the handled messages, rerunning the same
+command resumes an interrupted import.
+Usage:
+import notifications.mbox
+import receipt.eml
+import old-account --label Imported/old-account`,
+	Args: cobra.ExactArgs(1),
+	Run:  runImport,
+}
+
+var FlagImportLabel string
+
+func runImport(cmd *cobra.Command, args []string) {
+	result, err := internal.ImportMessages(args[0], FlagImportLabel)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("Imported %d messages, skipped %d already in the mailbox, %d failed to parse\n", result.Imported, result.Skipped, result.Failed)
+
+	FetchLabels()
+}
+
+func init() {
+	rootCmd.AddCommand(importCmd)
+
+	importCmd.Flags().StringVarP(&FlagImportLabel, "label", "l", "", "Also label every imported message with this label name")
+}
@@ -0,0 +1,53 @@
+/*
+Copyright © 2021 Aaron Romeo caduceus@aaronromeo.com
+
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	internal "aaronromeo/mailboxorg/caduceus/internal"
+
+	"github.com/spf13/cobra"
+)
+
+// limitsCmd represents the limits command
+var limitsCmd = &cobra.Command{
+	Use:   "limits",
+	Short: "Show the usage of the Gmail filter and label limits",
+	Long: `Show the number of filters, the longest filter query and the number of user labels
+against the Gmail limits, both now and once the pending migrations have run.
+Create-filter migrations with more than one user label are counted as the several
+filters they are split into. Run fetch first to refresh the local data.`,
+	Run: runLimits,
+}
+
+func runLimits(cmd *cobra.Command, args []string) {
+	migrationFiles, err := internal.PendingMigrationFiles()
+	if err != nil {
+		panic(err)
+	}
+
+	usages, err := internal.PredictLimits(migrationFiles)
+	if err != nil {
+		panic(err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "LIMIT\tCURRENT\tAFTER MIGRATIONS\tMAX\t")
+	for _, usage := range usages {
+		status := ""
+		if usage.Exceeded() {
+			status = "OVER LIMIT"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\n", usage.Name, usage.Current, usage.Predicted, usage.Limit, status)
+	}
+	w.Flush()
+}
+
+func init() {
+	rootCmd.AddCommand(limitsCmd)
+}
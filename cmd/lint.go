@@ -0,0 +1,55 @@
+/*
+Copyright © 2021 Aaron Romeo caduceus@aaronromeo.com
+
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	internal "aaronromeo/mailboxorg/caduceus/internal"
+
+	"github.com/spf13/cobra"
+)
+
+// lintCmd represents the lint command
+var lintCmd = &cobra.Command{
+	Use:   "lint",
+	Short: "Check filters, labels and pending migrations against the lint rules",
+	Long: `Check 'data/filters.json', 'data/labels.json' and the pending files in the 'migrations'
+folder against the lint rules. Exits with a non-zero status when an error is found.
+Rules:
+query-syntax         (error)   syntax errors and unknown search operators
+archive-needs-label  (error)   filters skipping the inbox must apply a user label
+forward-domain       (error)   filters may only forward to 'lint.allowedForwardDomains'
+subject-only         (warning) filters should not match on the subject alone
+label-title-case     (warning) user label names must be Title Case
+The severity of each rule can be changed in 'data/config.json', eg
+{"lint": {"rules": {"subject-only": "error", "label-title-case": "off"}, "allowedForwardDomains": ["example.com"]}}`,
+	Run: runLint,
+}
+
+func runLint(cmd *cobra.Command, args []string) {
+	issues, err := internal.Lint()
+	if err != nil {
+		panic(err)
+	}
+
+	errorCount := 0
+	for _, issue := range issues {
+		if issue.Severity == internal.LintSeverityError {
+			errorCount++
+		}
+		fmt.Printf("%s: %s: %s: [%s] %s\n", issue.Severity, issue.Source, issue.Subject, issue.Rule, issue.Message)
+	}
+
+	fmt.Printf("Found %d errors and %d warnings\n", errorCount, len(issues)-errorCount)
+	if errorCount > 0 {
+		os.Exit(1)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(lintCmd)
+}
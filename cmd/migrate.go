@@ -11,25 +11,41 @@ import (
 )
 
 var Daily bool = false
+var FlagMigrateDigest bool
 
 // migrateCmd represents the migrate command
 var migrateCmd = &cobra.Command{
 	Use:   "migrate",
 	Short: "Run a pending migration file located in the 'migrations' folder",
-	Long:  `Run a pending migration file located in the 'migrations' folder`,
+	Long: `Run a pending migration file located in the 'migrations' folder.
+The create-forwarding-address and delete-forwarding-address migrations need a service
+account with domain-wide delegation, Gmail refuses them to other accounts with a 403.`,
 	Run:   runMigrations,
 }
 
 func runMigrations(cmd *cobra.Command, args []string) {
+	// The labels and filters are refetched even when a migration fails, but only a
+	// successful run is remembered as the last migrate snapshot
+	migrated := false
 	defer func() {
 		FetchLabels()
 		FetchFilters()
+		if migrated {
+			SnapshotAccount(true)
+		}
 	}()
 
 	err := internal.RunMigrations(Daily)
 	if err != nil {
 		panic(err)
 	}
+	migrated = true
+
+	if FlagMigrateDigest {
+		if err := SendDigest(unsubscribeWindowDays, ""); err != nil {
+			panic(err)
+		}
+	}
 }
 
 func init() {
@@ -43,5 +59,6 @@ func init() {
 
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
-	migrateCmd.Flags().BoolVarP(&Daily, "daily", "d", false, "Run daily migrations (files with the mask daily-[0-9]*.json)")
+	migrateCmd.Flags().BoolVarP(&Daily, "daily", "d", false, "Run daily migrations (files with the mask daily-[0-9]*.json) and the retention policies")
+	migrateCmd.Flags().BoolVar(&FlagMigrateDigest, "digest", false, "Email the unsubscribe digest once the migrations have run")
 }
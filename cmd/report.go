@@ -0,0 +1,253 @@
+/*
+Copyright © 2021 Aaron Romeo caduceus@aaronromeo.com
+
+*/
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	internal "aaronromeo/mailboxorg/caduceus/internal"
+
+	"github.com/spf13/cobra"
+)
+
+const reportFormatTable string = "table"
+const reportFormatCSV string = "csv"
+const reportFormatJSON string = "json"
+
+// reportCmd represents the report command
+var reportCmd = &cobra.Command{
+	Use:   "report",
+	Short: "Reports on the messages in the mailbox",
+	Long: `Reports on the messages in the mailbox, built from the local message store.
+The store is synced before each report covering the whole mailbox.`,
+}
+
+var reportSendersCmd = &cobra.Command{
+	Use:   "senders",
+	Short: "Show who sends the most mail",
+	Long: `Aggregate the messages received over the last days by sender address or domain.
+Shows the number of messages, the share unread, the share still in the inbox, the share
+matched by a filter and the filter matching most of them, if any. Filters are matched
+against the message headers only, so filters on the body or attachments are missed.
+Usage:
+report senders --days 30 --by domain --format csv`,
+	Run: runReportSenders,
+}
+
+var reportStorageCmd = &cobra.Command{
+	Use:   "storage",
+	Short: "Show what is using the mailbox storage",
+	Long: `Break down the size of the messages by label, sender domain and age and list the
+largest messages. With --migrate, a migration file is written proposing to trash the
+largest messages and the mail older than a year from the heaviest sender domains. The
+old mail is selected by a search when the migration runs. Personal mail domains such as
+gmail.com and the domain of the account are never proposed.
+Usage:
+report storage
+report storage --label Newsletters --query "older_than:1y"
+report storage --migrate`,
+	Run: runReportStorage,
+}
+
+var FlagReportDays int
+var FlagReportBy string
+var FlagReportFormat string
+var FlagReportLimit int
+
+func runReportSenders(cmd *cobra.Command, args []string) {
+	if FlagReportBy != internal.SenderReportBySender && FlagReportBy != internal.SenderReportByDomain {
+		fmt.Printf("Unknown grouping %s, use sender or domain\n", FlagReportBy)
+		os.Exit(1)
+	}
+
+	// The window is selected by a search, the store only saves fetching the messages
+	// it already holds
+	store, err := internal.ReadLocalMessageStore()
+	if err != nil {
+		panic(err)
+	}
+	query := fmt.Sprintf("newer_than:%dd", FlagReportDays)
+	messages, err := internal.StorageMessages(store, []*internal.CadLabel{}, &query)
+	if err != nil {
+		panic(err)
+	}
+
+	report, err := internal.SenderReport(messages, FlagReportBy)
+	if err != nil {
+		panic(err)
+	}
+	if FlagReportLimit > 0 && len(report) > FlagReportLimit {
+		report = report[:FlagReportLimit]
+	}
+
+	rows := [][]string{}
+	for _, stats := range report {
+		rows = append(rows, []string{
+			stats.Sender,
+			strconv.Itoa(stats.Messages),
+			fmt.Sprintf("%.0f%%", stats.UnreadRatio*100),
+			fmt.Sprintf("%.0f%%", stats.InboxShare*100),
+			fmt.Sprintf("%.0f%%", stats.FilteredShare*100),
+			stats.FilterId,
+		})
+	}
+	writeReport(report, []string{FlagReportBy, "messages", "unread", "in inbox", "filtered", "filter"}, rows)
+}
+
+var FlagStorageLabel string
+var FlagStorageQuery string
+var FlagStorageLargest int
+var FlagStorageDomains int
+var FlagStorageMigrate bool
+
+func runReportStorage(cmd *cobra.Command, args []string) {
+	localLabels, err := internal.ReadLocalLabels()
+	if err != nil {
+		panic(err)
+	}
+
+	labelNames := map[string]string{}
+	labels := []*internal.CadLabel{}
+	for i, label := range localLabels {
+		labelNames[label.Id] = label.Name
+		if FlagStorageLabel != "" && strings.EqualFold(label.Name, FlagStorageLabel) {
+			labels = append(labels, &localLabels[i])
+		}
+	}
+	if FlagStorageLabel != "" && len(labels) == 0 {
+		fmt.Printf("Unable to find the label: %s\n", FlagStorageLabel)
+		os.Exit(1)
+	}
+	var query *string
+	if FlagStorageQuery != "" {
+		query = &FlagStorageQuery
+	}
+
+	// A label or query selects the messages through a search, only the whole mailbox
+	// report needs the message store to be up to date
+	if len(labels) == 0 && query == nil {
+		SyncMessages(false)
+	}
+	store, err := internal.ReadLocalMessageStore()
+	if err != nil {
+		panic(err)
+	}
+
+	messages, err := internal.StorageMessages(store, labels, query)
+	if err != nil {
+		panic(err)
+	}
+	report := internal.StorageReport(messages, labelNames, FlagStorageLargest)
+
+	if FlagReportFormat == reportFormatJSON {
+		writeReport(report, nil, nil)
+	} else {
+		header := []string{"name", "messages", "size"}
+		sections := []struct {
+			title   string
+			buckets []internal.CadStorageBucket
+		}{
+			{"By label", report.ByLabel},
+			{"By sender domain", report.ByDomain},
+			{"By age", report.ByAge},
+		}
+		fmt.Printf("%d messages, %s\n", report.Messages, internal.FormatBytes(report.Bytes))
+		for _, section := range sections {
+			buckets := section.buckets
+			if FlagReportLimit > 0 && len(buckets) > FlagReportLimit {
+				buckets = buckets[:FlagReportLimit]
+			}
+			rows := [][]string{}
+			for _, bucket := range buckets {
+				rows = append(rows, []string{bucket.Name, strconv.Itoa(bucket.Messages), internal.FormatBytes(bucket.Bytes)})
+			}
+			fmt.Printf("\n%s\n", section.title)
+			writeReport(buckets, header, rows)
+		}
+
+		rows := [][]string{}
+		for _, message := range report.Largest {
+			rows = append(rows, []string{
+				message.Id,
+				message.Date.Format("2006-01-02"),
+				internal.FormatBytes(message.Bytes),
+				message.From,
+				message.Subject,
+			})
+		}
+		fmt.Printf("\nLargest messages\n")
+		writeReport(report.Largest, []string{"id", "date", "size", "from", "subject"}, rows)
+	}
+
+	if FlagStorageMigrate {
+		accountAddress, err := internal.GetAccountAddress()
+		if err != nil {
+			panic(err)
+		}
+		labelIds := []string{}
+		for _, label := range labels {
+			labelIds = append(labelIds, label.Id)
+		}
+		migrations := internal.StorageMigrations(report, messages, labelIds, FlagStorageQuery, accountAddress, FlagStorageDomains)
+		if len(migrations) > 0 {
+			if err := internal.CreateMigrationFile(&migrations); err != nil {
+				panic(err)
+			}
+			fmt.Printf("Proposed %d migrations\n", len(migrations))
+		}
+	}
+}
+
+// writeReport prints the rows as a table or CSV, or the report itself as JSON
+func writeReport(report interface{}, header []string, rows [][]string) {
+	switch FlagReportFormat {
+	case reportFormatJSON:
+		b, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println(string(b))
+	case reportFormatCSV:
+		w := csv.NewWriter(os.Stdout)
+		w.Write(header)
+		w.WriteAll(rows)
+	case reportFormatTable:
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, row := range append([][]string{header}, rows...) {
+			for _, cell := range row {
+				fmt.Fprintf(w, "%s\t", cell)
+			}
+			fmt.Fprintln(w)
+		}
+		w.Flush()
+	default:
+		fmt.Printf("Unknown format %s, use table, csv or json\n", FlagReportFormat)
+		os.Exit(1)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(reportCmd)
+	reportCmd.AddCommand(reportSendersCmd)
+	reportCmd.AddCommand(reportStorageCmd)
+
+	reportCmd.PersistentFlags().StringVarP(&FlagReportFormat, "format", "f", reportFormatTable, "Output format (table|csv|json)")
+	reportCmd.PersistentFlags().IntVarP(&FlagReportLimit, "limit", "l", 25, "Number of rows to show, 0 shows all")
+
+	reportStorageCmd.Flags().StringVar(&FlagStorageLabel, "label", "", "Only include messages with this label name")
+	reportStorageCmd.Flags().StringVarP(&FlagStorageQuery, "query", "q", "", "Only include messages matching this search query")
+	reportStorageCmd.Flags().IntVar(&FlagStorageLargest, "largest", 20, "Number of largest messages to list")
+	reportStorageCmd.Flags().IntVar(&FlagStorageDomains, "domains", 5, "Number of heaviest sender domains to propose trashing old mail for")
+	reportStorageCmd.Flags().BoolVarP(&FlagStorageMigrate, "migrate", "m", false, "Write a migration file trashing the heaviest offenders")
+
+	reportSendersCmd.Flags().IntVarP(&FlagReportDays, "days", "n", 30, "Number of days of mail to include")
+	reportSendersCmd.Flags().StringVarP(&FlagReportBy, "by", "b", internal.SenderReportBySender, "Group by sender address or domain (sender|domain)")
+}
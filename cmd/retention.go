@@ -0,0 +1,61 @@
+/*
+Copyright © 2021 Aaron Romeo caduceus@aaronromeo.com
+
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	internal "aaronromeo/mailboxorg/caduceus/internal"
+
+	"github.com/spf13/cobra"
+)
+
+// retentionCmd represents the retention command
+var retentionCmd = &cobra.Command{
+	Use:   "retention",
+	Short: "Inspect the retention policies of the config",
+	Long: `Inspect the retention policies in the "retention" section of 'data/config.json'.
+The policies are applied by migrate --daily, after the daily migration files.
+Each policy has a label, olderThanDays, an action (archive, mark-read, relabel or trash),
+relabelTo for the relabel action and excludeStarred.`,
+}
+
+var retentionPreviewCmd = &cobra.Command{
+	Use:   "preview",
+	Short: "Show how many messages each retention policy would affect today",
+	Long: `Show how many messages each retention policy would affect if migrate --daily
+ran now, without changing anything.`,
+	Run: runRetentionPreview,
+}
+
+func runRetentionPreview(cmd *cobra.Command, args []string) {
+	config, err := internal.ReadConfig()
+	if err != nil {
+		panic(err)
+	}
+	if len(config.Retention) == 0 {
+		fmt.Println("No retention policies configured")
+		return
+	}
+
+	previews, err := internal.PreviewRetentionPolicies(config.Retention)
+	if err != nil {
+		panic(err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "POLICY\tQUERY\tMESSAGES\t")
+	for _, preview := range previews {
+		fmt.Fprintf(w, "%s\t%s\t%d\t\n", preview.Policy, preview.Query, preview.Messages)
+	}
+	w.Flush()
+}
+
+func init() {
+	rootCmd.AddCommand(retentionCmd)
+	retentionCmd.AddCommand(retentionPreviewCmd)
+}
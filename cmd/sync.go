@@ -0,0 +1,44 @@
+/*
+Copyright © 2021 Aaron Romeo caduceus@aaronromeo.com
+
+*/
+package cmd
+
+import (
+	"fmt"
+
+	internal "aaronromeo/mailboxorg/caduceus/internal"
+
+	"github.com/spf13/cobra"
+)
+
+// syncCmd represents the sync command
+var syncCmd = &cobra.Command{
+	Use:   "sync",
+	Short: "Sync the local message metadata store",
+	Long: `Sync the message metadata kept in 'data/messages.json' (ids, labels, dates, sizes
+and key headers) of the messages outside the trash and spam. The first sync fetches
+every message and saves its progress, rerunning an interrupted first sync resumes it.
+Later syncs only fetch the changes since the last one using the Gmail history.`,
+	Run: runSync,
+}
+
+var FlagFullSync bool
+
+func runSync(cmd *cobra.Command, args []string) {
+	SyncMessages(FlagFullSync)
+}
+
+func SyncMessages(full bool) {
+	store, err := internal.SyncMessageStore(full)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("Message store holds %d messages (history id %d)\n", len(store.Messages), store.HistoryId)
+}
+
+func init() {
+	rootCmd.AddCommand(syncCmd)
+
+	syncCmd.Flags().BoolVar(&FlagFullSync, "full", false, "Refetch every message instead of replaying the history")
+}
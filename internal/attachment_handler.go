@@ -0,0 +1,214 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const attachmentManifestFile string = "manifest.json"
+
+// CadAttachmentManifestEntry records an exported attachment. Filename is the name of the
+// file in the export directory, which is shared by identical attachments.
+type CadAttachmentManifestEntry struct {
+	MessageId        string    `json:"messageId"`
+	Sender           string    `json:"sender"`
+	Date             time.Time `json:"date"`
+	OriginalFilename string    `json:"originalFilename"`
+	Filename         string    `json:"filename"`
+	Size             int64     `json:"size"`
+	Sha256           string    `json:"sha256"`
+}
+
+var regUnsafeFilename = regexp.MustCompile(`[^\p{L}\p{N}._ -]+`)
+
+// ExportAttachments downloads the attachments of the messages matching the query into
+// dir and appends them to the manifest in dir. It returns the new manifest entries.
+func ExportAttachments(query string, dir string) ([]CadAttachmentManifestEntry, error) {
+	if query == "" {
+		return nil, errors.New("a query is required to select the messages")
+	}
+
+	srv, err := GetService()
+	if err != nil {
+		log.Printf("Unable to retrieve Gmail client: %v", err)
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		log.Printf("Unable to create export directory: %v", err)
+		return nil, err
+	}
+
+	manifestPath := filepath.Join(dir, attachmentManifestFile)
+	manifest, err := readAttachmentManifest(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	filesByHash := map[string]string{}
+	exported := map[string]bool{}
+	for _, entry := range manifest {
+		filesByHash[entry.Sha256] = entry.Filename
+		exported[entry.MessageId+"/"+entry.Sha256] = true
+	}
+
+	q := fmt.Sprintf("(%s) has:attachment", query)
+	ids, err := GetMessagesIDsByLabelIDs([]*CadLabel{}, &q)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []CadAttachmentManifestEntry{}
+	user := "me"
+	for i, id := range ids {
+		fmt.Printf("Exporting attachments of message %d/%d\n", i+1, len(ids))
+		message, err := srv.Users.Messages.Get(user, id).Format("full").Do()
+		if err != nil {
+			log.Printf("Unable to retrieve message: %s %v", id, err)
+			return entries, err
+		}
+		meta := MarshalCadMessageMeta(message)
+
+		content, err := ReadMessageContent(srv, message, true)
+		if err != nil {
+			return entries, err
+		}
+
+		for _, attachment := range content.Attachments {
+			sum := sha256.Sum256(attachment.Data)
+			hash := hex.EncodeToString(sum[:])
+			if exported[id+"/"+hash] {
+				continue
+			}
+
+			filename, ok := filesByHash[hash]
+			if !ok {
+				filename = uniqueFilename(dir, safeFilename(attachment.Filename))
+				if err := ioutil.WriteFile(filepath.Join(dir, filename), attachment.Data, 0664); err != nil {
+					log.Printf("Unable to write attachment %s: %v", filename, err)
+					return entries, err
+				}
+				filesByHash[hash] = filename
+			}
+			exported[id+"/"+hash] = true
+
+			entry := CadAttachmentManifestEntry{
+				MessageId:        id,
+				Sender:           MessageSender(meta),
+				Date:             meta.Date(),
+				OriginalFilename: attachment.Filename,
+				Filename:         filename,
+				Size:             int64(len(attachment.Data)),
+				Sha256:           hash,
+			}
+			entries = append(entries, entry)
+			manifest = append(manifest, entry)
+		}
+
+		// The manifest is saved per message so an interrupted export can be rerun
+		if err := saveAttachmentManifest(manifestPath, manifest); err != nil {
+			return entries, err
+		}
+	}
+
+	return entries, nil
+}
+
+// LabelExportedMessages labels the messages of the manifest in dir which do not have the
+// label yet, including the ones exported by earlier or interrupted runs. It returns the
+// number of messages labelled.
+func LabelExportedMessages(dir string, label *CadLabel) (int, error) {
+	manifest, err := readAttachmentManifest(filepath.Join(dir, attachmentManifestFile))
+	if err != nil {
+		return 0, err
+	}
+
+	labelled, err := GetMessagesIDsByLabelIDs([]*CadLabel{label}, nil)
+	if err != nil {
+		return 0, err
+	}
+	seen := map[string]bool{}
+	for _, id := range labelled {
+		seen[id] = true
+	}
+
+	messageIds := []string{}
+	for _, entry := range manifest {
+		if !seen[entry.MessageId] {
+			seen[entry.MessageId] = true
+			messageIds = append(messageIds, entry.MessageId)
+		}
+	}
+	if len(messageIds) == 0 {
+		return 0, nil
+	}
+
+	if err := BulkUpdateMessageLabels(messageIds, []string{label.Id}, []string{}); err != nil {
+		return 0, err
+	}
+	return len(messageIds), nil
+}
+
+// safeFilename strips directories and characters which are unsafe in filenames
+func safeFilename(filename string) string {
+	filename = filepath.Base(strings.ReplaceAll(filename, "\\", "/"))
+	filename = regUnsafeFilename.ReplaceAllString(filename, "_")
+	filename = strings.Trim(filename, ". ")
+	if filename == "" || filename == attachmentManifestFile {
+		filename = "attachment"
+	}
+	return filename
+}
+
+// uniqueFilename adds a counter before the extension until the name is unused in dir
+func uniqueFilename(dir string, filename string) string {
+	ext := filepath.Ext(filename)
+	base := strings.TrimSuffix(filename, ext)
+	candidate := filename
+	for i := 1; fileExists(filepath.Join(dir, candidate)); i++ {
+		candidate = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+	return candidate
+}
+
+func readAttachmentManifest(path string) ([]CadAttachmentManifestEntry, error) {
+	if !fileExists(path) {
+		return []CadAttachmentManifestEntry{}, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Printf("Unable to read attachment manifest: %v", err)
+		return nil, err
+	}
+	var manifest []CadAttachmentManifestEntry
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		log.Printf("Unable to parse attachment manifest: %v", err)
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func saveAttachmentManifest(path string, manifest []CadAttachmentManifestEntry) error {
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		log.Printf("Unable to marshal attachment manifest to JSON: %v", err)
+		return err
+	}
+
+	err = ioutil.WriteFile(path, b, 0664)
+	if err != nil {
+		log.Printf("Unable to persist attachment manifest: %v", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+const BackfillScopeInbox string = "inbox"
+const BackfillScopeAll string = "all"
+
+// CadBackfillScope limits which existing mail a filter is applied to.
+// After and Before are dates formatted as YYYY-MM-DD and Query holds extra search terms.
+type CadBackfillScope struct {
+	Mailbox string `json:"mailbox,omitempty"`
+	After   string `json:"after,omitempty"`
+	Before  string `json:"before,omitempty"`
+	Query   string `json:"query,omitempty"`
+}
+
+// BackfillMessageIds returns the existing messages within the scope that match the filter criteria
+func BackfillMessageIds(filter CadFilter, scope CadBackfillScope) ([]string, error) {
+	if filter.Criteria == nil {
+		return nil, errors.New("no filter criteria")
+	}
+
+	criteriaQuery := CriteriaQuery(*filter.Criteria)
+	if criteriaQuery == "" {
+		return nil, errors.New("no filter criteria")
+	}
+
+	parts := []string{criteriaQuery}
+	if scope.Query != "" {
+		parts = append(parts, scope.Query)
+	}
+	for _, bound := range []struct {
+		operator string
+		value    string
+	}{
+		{"after", scope.After},
+		{"before", scope.Before},
+	} {
+		if bound.value == "" {
+			continue
+		}
+		date, err := time.Parse("2006-01-02", bound.value)
+		if err != nil {
+			log.Printf("Unable to parse %s date %s: %v", bound.operator, bound.value, err)
+			return nil, err
+		}
+		parts = append(parts, fmt.Sprintf("%s:%s", bound.operator, date.Format("2006/01/02")))
+	}
+	q := strings.Join(parts, " ")
+
+	labels := []*CadLabel{}
+	switch scope.Mailbox {
+	case "", BackfillScopeInbox:
+		labels = append(labels, &CadLabel{Id: "INBOX", Name: "INBOX"})
+	case BackfillScopeAll:
+	default:
+		return nil, fmt.Errorf("unknown backfill scope %s", scope.Mailbox)
+	}
+
+	return GetMessagesIDsByLabelIDs(labels, &q)
+}
+
+// ApplyFilterAction applies a filter's action to existing messages, optionally
+// forwarding each message when the action has a forwarding address
+func ApplyFilterAction(messageIds []string, action CadAction, forward bool) error {
+	if len(messageIds) == 0 {
+		return nil
+	}
+
+	if len(action.AddLabelIds) > 0 || len(action.RemoveLabelIds) > 0 {
+		err := BulkUpdateMessageLabels(messageIds, action.AddLabelIds, action.RemoveLabelIds)
+		if err != nil {
+			log.Printf("Unable to modify messages: %v", err)
+			return err
+		}
+	}
+
+	if forward && action.Forward != "" {
+		for _, messageId := range messageIds {
+			if err := ForwardMessage(messageId, action.Forward); err != nil {
+				log.Printf("Unable to forward message %s: %v", messageId, err)
+				return err
+			}
+		}
+	}
+
+	return nil
+}
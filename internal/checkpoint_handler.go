@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// Checkpoints of long running exports and imports are append-only logs with one JSON
+// record per line, so recording a message does not rewrite the whole checkpoint.
+
+// appendCheckpoint appends a record to a checkpoint log
+func appendCheckpoint(path string, record interface{}) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Unable to marshal checkpoint record to JSON: %v", err)
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0664)
+	if err != nil {
+		log.Printf("Unable to open checkpoint %s: %v", path, err)
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		log.Printf("Unable to persist checkpoint %s: %v", path, err)
+		return err
+	}
+	return nil
+}
+
+// readCheckpoint calls read with each record of a checkpoint log. A last line left
+// incomplete by an interrupted run is dropped from the file.
+func readCheckpoint(path string, read func(line []byte) error) error {
+	if !fileExists(path) {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Printf("Unable to read checkpoint %s: %v", path, err)
+		return err
+	}
+	if complete := bytes.LastIndexByte(b, '\n') + 1; complete < len(b) {
+		if err := os.Truncate(path, int64(complete)); err != nil {
+			log.Printf("Unable to repair checkpoint %s: %v", path, err)
+			return err
+		}
+		b = b[:complete]
+	}
+
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		if err := read(line); err != nil {
+			log.Printf("Unable to parse checkpoint %s: %v", path, err)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// CadFilterCompaction groups sender-only filters that share an action and the
+// queries that replace them
+type CadFilterCompaction struct {
+	Action    CadAction `json:"action"`
+	FilterIds []string  `json:"filterIds"`
+	Senders   []string  `json:"senders"`
+	Queries   []string  `json:"queries"`
+}
+
+// CompactFilters merges local filters that only match on senders and share the
+// same action into as few from:(a OR b) filters as the query length limit allows
+func CompactFilters() ([]CadFilterCompaction, error) {
+	filters, err := ReadLocalFilters()
+	if err != nil {
+		log.Printf("Unable to read local filters file: %v", err)
+		return nil, err
+	}
+
+	groups := map[string]*CadFilterCompaction{}
+	for _, filter := range filters {
+		if filter.Criteria == nil || filter.Action == nil {
+			continue
+		}
+		senders, ok := senderOnlyCriteria(*filter.Criteria)
+		if !ok {
+			continue
+		}
+
+		key := ActionKey(*filter.Action)
+		group, ok := groups[key]
+		if !ok {
+			group = &CadFilterCompaction{Action: *filter.Action}
+			groups[key] = group
+		}
+		group.FilterIds = append(group.FilterIds, filter.Id)
+		group.Senders = append(group.Senders, senders...)
+	}
+
+	compactions := []CadFilterCompaction{}
+	for _, group := range groups {
+		if len(group.FilterIds) < 2 {
+			continue
+		}
+
+		seen := map[string]bool{}
+		for _, sender := range group.Senders {
+			seen[sender] = true
+		}
+		group.Senders = sortedKeys(seen)
+		group.Queries = senderQueries(group.Senders)
+
+		if len(group.Queries) < len(group.FilterIds) {
+			compactions = append(compactions, *group)
+		}
+	}
+	sort.SliceStable(compactions, func(i, j int) bool {
+		return ActionKey(compactions[i].Action) < ActionKey(compactions[j].Action)
+	})
+
+	return compactions, nil
+}
+
+// CompactionMigrations creates the replacement filters before deleting the ones they merge
+func CompactionMigrations(compactions []CadFilterCompaction) []CadRawMigration {
+	migrations := []CadRawMigration{}
+	for _, compaction := range compactions {
+		for _, query := range compaction.Queries {
+			operation := CreateFilterMigration
+			note := fmt.Sprintf("Compacted filter replacing %d filters", len(compaction.FilterIds))
+			action := compaction.Action
+			migrations = append(migrations, CadRawMigration{
+				Operation: &operation,
+				Details: CadCreateFilterMigration{
+					Criteria: &CadCriteria{Query: query},
+					Action:   &action,
+				},
+				Note: &note,
+			})
+		}
+
+		operation := DeleteFiltersMigration
+		note := fmt.Sprintf("Compacted %d filters into %d", len(compaction.FilterIds), len(compaction.Queries))
+		ids := compaction.FilterIds
+		migrations = append(migrations, CadRawMigration{
+			Operation: &operation,
+			Details:   CadDeleteFiltersMigration{Ids: &ids},
+			Note:      &note,
+		})
+	}
+
+	return migrations
+}
+
+// senderOnlyCriteria returns the sender addresses of criteria that match on nothing but the sender
+func senderOnlyCriteria(criteria CadCriteria) ([]string, bool) {
+	node, err := CriteriaNode(criteria)
+	if err != nil {
+		return nil, false
+	}
+
+	terms := []*CadQueryNode{node}
+	if node.Kind == QueryOr {
+		terms = node.Children
+	}
+
+	senders := []string{}
+	for _, term := range terms {
+		if term.Kind != QueryTerm || term.Operator != "from" || strings.ContainsAny(term.Value, " \t") {
+			return nil, false
+		}
+		senders = append(senders, term.Value)
+	}
+
+	return senders, len(senders) > 0
+}
+
+func senderQueries(senders []string) []string {
+	queries := []string{}
+	chunk := []string{}
+	render := func(senders []string) string {
+		return fmt.Sprintf("from:(%s)", strings.Join(senders, " OR "))
+	}
+
+	for _, sender := range senders {
+		if len(chunk) > 0 && len(render(append(chunk, sender))) > maxFilterQueryLength {
+			queries = append(queries, render(chunk))
+			chunk = []string{}
+		}
+		chunk = append(chunk, sender)
+	}
+	if len(chunk) > 0 {
+		queries = append(queries, render(chunk))
+	}
+
+	return queries
+}
@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+)
+
+const configdatafile string = "data/config.json"
+
+const defaultSnapshotRetention int = 30
+
+// CadSnapshotConfig controls the snapshots kept on every fetch. Retention is the
+// number of snapshots kept, 0 uses the default and a negative value keeps them all.
+type CadSnapshotConfig struct {
+	Retention int `json:"retention,omitempty"`
+}
+
+// CadLintConfig sets the severity of each lint rule (error, warning or off) and
+// the domains filters may forward to
+type CadLintConfig struct {
+	Rules                 map[string]string `json:"rules,omitempty"`
+	AllowedForwardDomains []string          `json:"allowedForwardDomains,omitempty"`
+}
+
+type CadConfig struct {
+	Snapshots CadSnapshotConfig    `json:"snapshots,omitempty"`
+	Lint      CadLintConfig        `json:"lint,omitempty"`
+	Retention []CadRetentionPolicy `json:"retention,omitempty"`
+}
+
+func ReadConfig() (*CadConfig, error) {
+	config := &CadConfig{}
+	if fileExists(configdatafile) {
+		b, err := ioutil.ReadFile(configdatafile)
+		if err != nil {
+			log.Printf("Unable to read config file: %v", err)
+			return nil, err
+		}
+		if err := json.Unmarshal(b, config); err != nil {
+			log.Printf("Unable to parse config file: %v", err)
+			return nil, err
+		}
+	}
+
+	if config.Snapshots.Retention == 0 {
+		config.Snapshots.Retention = defaultSnapshotRetention
+	}
+
+	return config, nil
+}
@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"mime/quotedprintable"
+	"time"
+)
+
+// CadDigestSuggestion is one sender worth unsubscribing from. Filter is the search
+// query of the proposed filter, which would archive the sender's mail.
+type CadDigestSuggestion struct {
+	Sender          string
+	Count           int
+	Subjects        []string
+	UnsubscribeLink string
+	Filter          string
+}
+
+type CadDigest struct {
+	GeneratedAt time.Time
+	Since       time.Time
+	Suggestions []CadDigestSuggestion
+}
+
+var digestTemplate = template.Must(template.New("digest").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Caduceus digest</title>
+</head>
+<body style="font-family: sans-serif;">
+<h1>Unsubscribe suggestions</h1>
+<p>{{len .Suggestions}} senders found in the inbox since {{.Since.Format "2006-01-02"}}.</p>
+<table cellpadding="6" style="border-collapse: collapse;">
+<tr style="text-align: left;">
+<th>Sender</th><th>Messages</th><th>Sample subjects</th><th>Unsubscribe</th><th>Proposed filter</th>
+</tr>
+{{range .Suggestions}}<tr style="border-top: 1px solid #ddd; vertical-align: top;">
+<td>{{.Sender}}</td>
+<td>{{.Count}}</td>
+<td>{{range .Subjects}}{{.}}<br>{{end}}</td>
+<td>{{if .UnsubscribeLink}}<a href="{{.UnsubscribeLink}}">Unsubscribe</a>{{end}}</td>
+<td><code>{{.Filter}}</code></td>
+</tr>
+{{end}}</table>
+<p style="color: #888;">Generated {{.GeneratedAt.Format "2006-01-02 15:04"}}</p>
+</body>
+</html>
+`))
+
+// BuildDigest turns the unsubscribe analysis into a digest, busiest senders first
+func BuildDigest(suggestions []*CadCriteraAndSampleMessage, since time.Time) CadDigest {
+	digest := CadDigest{GeneratedAt: time.Now(), Since: since}
+	for _, suggestion := range suggestions {
+		criteria := *suggestion.Criteria
+		sender := criteria.From
+		if criteria.Query != "" {
+			sender = criteria.Query
+		} else if sender == "" {
+			sender = criteria.To
+		}
+
+		digest.Suggestions = append(digest.Suggestions, CadDigestSuggestion{
+			Sender:          sender,
+			Count:           suggestion.Count,
+			Subjects:        suggestion.Subjects,
+			UnsubscribeLink: suggestion.UnsubscribeLink,
+			Filter:          CriteriaQuery(criteria),
+		})
+	}
+	return digest
+}
+
+func RenderDigest(digest CadDigest) ([]byte, error) {
+	var b bytes.Buffer
+	if err := digestTemplate.Execute(&b, digest); err != nil {
+		log.Printf("Unable to render digest: %v", err)
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// SendDigest mails the rendered digest to the account owner
+func SendDigest(html []byte) error {
+	srv, err := GetService()
+	if err != nil {
+		log.Printf("Unable to retrieve Gmail client: %v", err)
+		return err
+	}
+
+	user := "me"
+	profile, err := srv.Users.GetProfile(user).Do()
+	if err != nil {
+		log.Printf("Unable to retrieve profile: %v", err)
+		return err
+	}
+
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "To: %s\r\n", profile.EmailAddress)
+	fmt.Fprintf(&body, "Subject: Caduceus digest %s\r\n", time.Now().Format("2006-01-02"))
+	fmt.Fprintf(&body, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&body, "Content-Type: text/html; charset=utf-8\r\n")
+	fmt.Fprintf(&body, "Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	writer := quotedprintable.NewWriter(&body)
+	if _, err := writer.Write(html); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	return SendMessage(body.Bytes())
+}
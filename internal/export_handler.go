@@ -0,0 +1,216 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const ExportFormatMbox string = "mbox"
+const ExportFormatEmlDir string = "eml-dir"
+
+// The header recording the Gmail labels of an exported message, as in Google Takeout
+const gmailLabelsHeader string = "X-Gmail-Labels"
+
+const exportCheckpointFile string = "checkpoint.jsonl"
+
+// CadExportCheckpoint records a message written to an export so an interrupted export
+// resumes where it stopped. MboxSize is the size of the mbox after the message,
+// anything past the last recorded size is a partly written message.
+type CadExportCheckpoint struct {
+	Format    string `json:"format"`
+	MessageId string `json:"messageId"`
+	MboxSize  int64  `json:"mboxSize,omitempty"`
+}
+
+var regMboxFrom = regexp.MustCompile(`^>*From `)
+
+// ExportMessages writes the raw messages with the labels matching the query to an mbox
+// file or to a directory of .eml files, adding an X-Gmail-Labels header to each. It
+// returns the number of messages exported by this run.
+func ExportMessages(labels []*CadLabel, query *string, format string, path string) (int, error) {
+	if len(labels) == 0 && query == nil {
+		return 0, errors.New("a label or a query is required to select the messages")
+	}
+	if format != ExportFormatMbox && format != ExportFormatEmlDir {
+		return 0, fmt.Errorf("unknown export format %s, use mbox or eml-dir", format)
+	}
+
+	srv, err := GetService()
+	if err != nil {
+		log.Printf("Unable to retrieve Gmail client: %v", err)
+		return 0, err
+	}
+
+	allLabels, err := GetLabels()
+	if err != nil {
+		log.Printf("Unable to retrieve labels: %v", err)
+		return 0, err
+	}
+	labelNames := map[string]string{}
+	for _, label := range allLabels {
+		labelNames[label.Id] = label.Name
+	}
+
+	checkpointPath := filepath.Join(path, exportCheckpointFile)
+	if format == ExportFormatMbox {
+		checkpointPath = path + "." + exportCheckpointFile
+	} else if err := os.MkdirAll(path, 0775); err != nil {
+		log.Printf("Unable to create export directory: %v", err)
+		return 0, err
+	}
+	exported, mboxSize, err := readExportCheckpoint(checkpointPath, format)
+	if err != nil {
+		return 0, err
+	}
+
+	var mbox *os.File
+	if format == ExportFormatMbox {
+		if info, err := os.Stat(path); err == nil && info.Size() > 0 && !fileExists(checkpointPath) {
+			return 0, fmt.Errorf("%s already exists and is not a resumable export", path)
+		}
+		mbox, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0664)
+		if err != nil {
+			log.Printf("Unable to open mbox file: %v", err)
+			return 0, err
+		}
+		defer mbox.Close()
+		// Drop a message left half written by an interrupted export
+		if err := mbox.Truncate(mboxSize); err != nil {
+			log.Printf("Unable to truncate mbox file: %v", err)
+			return 0, err
+		}
+		if _, err := mbox.Seek(mboxSize, 0); err != nil {
+			return 0, err
+		}
+	}
+
+	ids, err := GetMessagesIDsByLabelIDs(labels, query)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	user := "me"
+	for i, id := range ids {
+		if exported[id] {
+			continue
+		}
+		fmt.Printf("Exporting message %d/%d\n", i+1, len(ids))
+
+		message, err := srv.Users.Messages.Get(user, id).Format("raw").Do()
+		if err != nil {
+			log.Printf("Unable to retrieve message: %s %v", id, err)
+			return count, err
+		}
+		raw, err := decodeBase64(message.Raw)
+		if err != nil {
+			log.Printf("Unable to decode message %s: %v", id, err)
+			return count, err
+		}
+
+		names := []string{}
+		for _, labelId := range message.LabelIds {
+			if name, ok := labelNames[labelId]; ok {
+				names = append(names, name)
+			} else {
+				names = append(names, labelId)
+			}
+		}
+		// A message imported from an earlier export already has the header
+		raw = removeHeader(raw, gmailLabelsHeader)
+		raw = append([]byte(fmt.Sprintf("%s: %s\r\n", gmailLabelsHeader, formatGmailLabels(names))), raw...)
+		date := time.Unix(0, message.InternalDate*int64(time.Millisecond)).UTC()
+
+		if format == ExportFormatMbox {
+			n, err := mbox.Write(mboxEntry(raw, date))
+			if err != nil {
+				log.Printf("Unable to write to mbox file: %v", err)
+				return count, err
+			}
+			mboxSize += int64(n)
+		} else {
+			filename := fmt.Sprintf("%s-%s.eml", date.Format("20060102-150405"), id)
+			if err := ioutil.WriteFile(filepath.Join(path, filename), raw, 0664); err != nil {
+				log.Printf("Unable to write message %s: %v", filename, err)
+				return count, err
+			}
+		}
+
+		exported[id] = true
+		record := CadExportCheckpoint{Format: format, MessageId: id}
+		if format == ExportFormatMbox {
+			record.MboxSize = mboxSize
+		}
+		if err := appendCheckpoint(checkpointPath, record); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+// mboxEntry formats a message for an mboxrd file: a From separator line, the message
+// with LF line endings and From lines quoted with '>', then a blank line
+func mboxEntry(raw []byte, date time.Time) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From MAILER-DAEMON %s\n", date.Format(time.ANSIC))
+
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	scanner.Buffer(make([]byte, 64*1024), len(raw)+1)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if regMboxFrom.MatchString(line) {
+			line = ">" + line
+		}
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+	b.WriteString("\n")
+	return b.Bytes()
+}
+
+// formatGmailLabels joins label names for the X-Gmail-Labels header, quoting the names
+// containing commas or quotes like CSV and encoding non-ASCII names
+func formatGmailLabels(names []string) string {
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	w.Write(names)
+	w.Flush()
+	return mime.QEncoding.Encode("utf-8", strings.TrimRight(b.String(), "\r\n"))
+}
+
+// readExportCheckpoint returns the exported message ids and the size of the mbox after
+// the last exported message
+func readExportCheckpoint(path string, format string) (map[string]bool, int64, error) {
+	exported := map[string]bool{}
+	mboxSize := int64(0)
+	err := readCheckpoint(path, func(line []byte) error {
+		record := CadExportCheckpoint{}
+		if err := json.Unmarshal(line, &record); err != nil {
+			return err
+		}
+		if record.Format != format {
+			return fmt.Errorf("the export at %s was started in the %s format", path, record.Format)
+		}
+		exported[record.MessageId] = true
+		mboxSize = record.MboxSize
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return exported, mboxSize, nil
+}
@@ -0,0 +1,67 @@
+package internal
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestGmailLabelsRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels []string
+		header string
+	}{
+		{name: "plain", labels: []string{"INBOX", "UNREAD", "Work/Projects"}, header: "INBOX,UNREAD,Work/Projects"},
+		{name: "comma", labels: []string{"INBOX", "Bills, paid"}, header: `INBOX,"Bills, paid"`},
+		{name: "quote", labels: []string{`The "good" stuff`}, header: `"The ""good"" stuff"`},
+		{name: "non ascii", labels: []string{"Café", "INBOX"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := formatGmailLabels(tt.labels)
+			if tt.header != "" && header != tt.header {
+				t.Errorf("formatGmailLabels() = %q, want %q", header, tt.header)
+			}
+			if got := parseGmailLabels(header); !reflect.DeepEqual(got, tt.labels) {
+				t.Errorf("parseGmailLabels(%q) = %q, want %q", header, got, tt.labels)
+			}
+		})
+	}
+}
+
+func TestReadExportCheckpointDropsIncompleteLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), exportCheckpointFile)
+	for _, record := range []CadExportCheckpoint{
+		{Format: ExportFormatMbox, MessageId: "a", MboxSize: 10},
+		{Format: ExportFormatMbox, MessageId: "b", MboxSize: 25},
+	} {
+		if err := appendCheckpoint(path, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, _ := ioutil.ReadFile(path)
+	ioutil.WriteFile(path, append(b, []byte(`{"format":"mbox","messageId":"c","mbo`)...), 0664)
+
+	exported, mboxSize, err := readExportCheckpoint(path, ExportFormatMbox)
+	if err != nil {
+		t.Fatalf("readExportCheckpoint() error = %v", err)
+	}
+	if !reflect.DeepEqual(exported, map[string]bool{"a": true, "b": true}) || mboxSize != 25 {
+		t.Errorf("readExportCheckpoint() = %v, %d, want a and b, 25", exported, mboxSize)
+	}
+
+	if err := appendCheckpoint(path, CadExportCheckpoint{Format: ExportFormatMbox, MessageId: "c", MboxSize: 40}); err != nil {
+		t.Fatal(err)
+	}
+	exported, mboxSize, err = readExportCheckpoint(path, ExportFormatMbox)
+	if err != nil || len(exported) != 3 || mboxSize != 40 {
+		t.Errorf("readExportCheckpoint() = %v, %d, %v after resuming", exported, mboxSize, err)
+	}
+
+	if _, _, err := readExportCheckpoint(path, ExportFormatEmlDir); err == nil {
+		t.Errorf("readExportCheckpoint() accepted a checkpoint of another format")
+	}
+}
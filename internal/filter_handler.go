@@ -45,6 +45,11 @@ type CadFilter struct {
 	Meta     *CadFilterMeta `json:"meta,omitempty"`
 }
 
+type CadBrokenFilter struct {
+	Filter          CadFilter `json:"filter"`
+	MissingLabelIds []string  `json:"missingLabelIds"`
+}
+
 type CadConsolidatedAction struct {
 	AddLabelIds    []string `json:"addLabelIds,omitempty"`
 	RemoveLabelIds []string `json:"removeLabelIds,omitempty"`
@@ -95,6 +100,61 @@ func GetFilters() ([]*CadFilter, error) {
 	return filters, nil
 }
 
+// BrokenFilters returns the local filters whose actions reference labels that no longer exist
+func BrokenFilters() ([]CadBrokenFilter, error) {
+	filters, err := ReadLocalFilters()
+	if err != nil {
+		log.Printf("Unable to read local filters file: %v", err)
+		return nil, err
+	}
+
+	localLabels, err := ReadLocalLabels()
+	if err != nil {
+		log.Printf("Unable to read local labels: %v", err)
+		return nil, err
+	}
+	if len(localLabels) == 0 {
+		return []CadBrokenFilter{}, nil
+	}
+
+	labelmap := map[string]bool{}
+	for _, label := range localLabels {
+		labelmap[label.Id] = true
+	}
+
+	brokenFilters := []CadBrokenFilter{}
+	for _, filter := range filters {
+		if filter.Action == nil {
+			continue
+		}
+		missing := []string{}
+		for _, labelId := range append(append([]string{}, filter.Action.AddLabelIds...), filter.Action.RemoveLabelIds...) {
+			if !labelmap[labelId] {
+				missing = append(missing, labelId)
+			}
+		}
+		if len(missing) > 0 {
+			brokenFilters = append(brokenFilters, CadBrokenFilter{Filter: filter, MissingLabelIds: missing})
+		}
+	}
+
+	return brokenFilters, nil
+}
+
+// FiltersReferencingLabel returns the filters that add or remove the label
+func FiltersReferencingLabel(filters []CadFilter, labelId string) []CadFilter {
+	referencing := []CadFilter{}
+	for _, filter := range filters {
+		if filter.Action == nil {
+			continue
+		}
+		if contains(filter.Action.AddLabelIds, labelId) || contains(filter.Action.RemoveLabelIds, labelId) {
+			referencing = append(referencing, filter)
+		}
+	}
+	return referencing
+}
+
 func SelectArchiveFilters() ([]CadFilter, error) {
 	filters, err := ReadLocalFilters()
 	if err != nil {
@@ -276,14 +336,7 @@ func SaveLocalFilters(filters []*CadFilter) error {
 	}
 
 	for i, filter := range filters {
-		meta := &CadFilterMeta{}
-		for _, labelId := range filter.Action.AddLabelIds {
-			meta.Labels = append(meta.Labels, labelmap[labelId])
-		}
-		for _, labelId := range filter.Action.RemoveLabelIds {
-			meta.Labels = append(meta.Labels, labelmap[labelId])
-		}
-		filters[i].Meta = meta
+		filters[i].Meta = filterMeta(filter.Action.AddLabelIds, filter.Action.RemoveLabelIds, labelmap)
 	}
 
 	b, err := json.MarshalIndent(filters, "", "  ")
@@ -300,14 +353,7 @@ func SaveLocalFilters(filters []*CadFilter) error {
 
 	consolidatedFilters, _ := consolidateFiltersByCriteria(filters)
 	for i, filter := range consolidatedFilters {
-		meta := &CadFilterMeta{}
-		for _, labelId := range filter.Action.AddLabelIds {
-			meta.Labels = append(meta.Labels, labelmap[labelId])
-		}
-		for _, labelId := range filter.Action.RemoveLabelIds {
-			meta.Labels = append(meta.Labels, labelmap[labelId])
-		}
-		consolidatedFilters[i].Meta = meta
+		consolidatedFilters[i].Meta = filterMeta(filter.Action.AddLabelIds, filter.Action.RemoveLabelIds, labelmap)
 	}
 
 	b, err = json.MarshalIndent(consolidatedFilters, "", "  ")
@@ -325,6 +371,17 @@ func SaveLocalFilters(filters []*CadFilter) error {
 	return nil
 }
 
+// filterMeta looks up the labels used by a filter action, skipping labels that no longer exist
+func filterMeta(addLabelIds []string, removeLabelIds []string, labelmap map[string]CadLabel) *CadFilterMeta {
+	meta := &CadFilterMeta{}
+	for _, labelId := range append(append([]string{}, addLabelIds...), removeLabelIds...) {
+		if label, ok := labelmap[labelId]; ok {
+			meta.Labels = append(meta.Labels, label)
+		}
+	}
+	return meta
+}
+
 func ReadLocalFilters() ([]CadFilter, error) {
 	if !fileExists(filterdatafile) {
 		return []CadFilter{}, nil
@@ -398,13 +455,66 @@ func consolidateFiltersByCriteria(filters []*CadFilter) ([]*CadConsolidatedFilte
 	return consolidatedFilters, nil
 }
 
+// CriteriaQuery translates filter criteria into the equivalent Gmail search query
+func CriteriaQuery(criteria CadCriteria) string {
+	parts := []string{}
+	if criteria.From != "" {
+		parts = append(parts, "from:"+groupQueryValue(criteria.From))
+	}
+	if criteria.To != "" {
+		parts = append(parts, "to:"+groupQueryValue(criteria.To))
+	}
+	if criteria.Subject != "" {
+		parts = append(parts, "subject:"+groupQueryValue(criteria.Subject))
+	}
+	if criteria.Query != "" {
+		parts = append(parts, groupQueryValue(criteria.Query))
+	}
+	if criteria.NegatedQuery != "" {
+		// Gmail excludes mail containing any of the words of the negated query
+		parts = append(parts, fmt.Sprintf("-{%s}", criteria.NegatedQuery))
+	}
+	if criteria.HasAttachment {
+		parts = append(parts, "has:attachment")
+	}
+	if criteria.ExcludeChats {
+		parts = append(parts, "-in:chats")
+	}
+	if criteria.Size > 0 {
+		switch strings.ToLower(criteria.SizeComparison) {
+		case "larger":
+			parts = append(parts, fmt.Sprintf("larger:%d", criteria.Size))
+		case "smaller":
+			parts = append(parts, fmt.Sprintf("smaller:%d", criteria.Size))
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// groupQueryValue wraps values made of several terms in parentheses so that an
+// operator or negation applies to all of them
+func groupQueryValue(value string) string {
+	value = strings.TrimSpace(value)
+	single, err := isSingleQueryPrimary(value)
+	if err != nil {
+		// Leave the syntax error to Gmail, only grouping values with several words
+		single = !strings.ContainsAny(value, " \t")
+	}
+	if value == "" || single {
+		return value
+	}
+	return fmt.Sprintf("(%s)", value)
+}
+
 func CriteriaKey(criteria CadCriteria) string {
 	return fmt.Sprintf(
-		"%s|%s|%s|%s|%d|%s|%t|%t",
-		criteria.From,
-		criteria.To,
-		criteria.Query,
-		criteria.NegatedQuery,
+		"%s|%s|%s|%s|%s|%d|%s|%t|%t",
+		NormalizeQuery(criteria.From),
+		NormalizeQuery(criteria.To),
+		NormalizeQuery(criteria.Subject),
+		NormalizeQuery(criteria.Query),
+		NormalizeQuery(criteria.NegatedQuery),
 		criteria.Size,
 		criteria.SizeComparison,
 		criteria.HasAttachment,
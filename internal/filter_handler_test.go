@@ -0,0 +1,88 @@
+package internal
+
+import "testing"
+
+func TestCriteriaQuery(t *testing.T) {
+	tests := []struct {
+		name     string
+		criteria CadCriteria
+		want     string
+	}{
+		{name: "empty", criteria: CadCriteria{}, want: ""},
+		{name: "from", criteria: CadCriteria{From: "a@x.com"}, want: "from:a@x.com"},
+		{name: "from several senders", criteria: CadCriteria{From: "a@x.com OR b@y.com"}, want: "from:(a@x.com OR b@y.com)"},
+		{name: "from already grouped", criteria: CadCriteria{From: "(a@x.com OR b@y.com)"}, want: "from:(a@x.com OR b@y.com)"},
+		{name: "from braces", criteria: CadCriteria{From: "{a@x.com b@y.com}"}, want: "from:{a@x.com b@y.com}"},
+		{name: "from two groups", criteria: CadCriteria{From: "(a) OR (b)"}, want: "from:((a) OR (b))"},
+		{name: "to", criteria: CadCriteria{To: "me@x.com"}, want: "to:me@x.com"},
+		{name: "to with spaces", criteria: CadCriteria{To: "  me@x.com  "}, want: "to:me@x.com"},
+		{name: "subject word", criteria: CadCriteria{Subject: "invoice"}, want: "subject:invoice"},
+		{name: "subject words", criteria: CadCriteria{Subject: "weekly digest"}, want: "subject:(weekly digest)"},
+		{name: "subject phrase", criteria: CadCriteria{Subject: `"weekly digest"`}, want: `subject:"weekly digest"`},
+		{name: "subject phrases and word", criteria: CadCriteria{Subject: `"x" y "z"`}, want: `subject:("x" y "z")`},
+		{name: "subject negation", criteria: CadCriteria{Subject: "-draft"}, want: "subject:(-draft)"},
+		{name: "query term", criteria: CadCriteria{Query: "list:news.x.com"}, want: "list:news.x.com"},
+		{name: "query terms", criteria: CadCriteria{Query: "unsubscribe OR newsletter"}, want: "(unsubscribe OR newsletter)"},
+		{name: "negated query", criteria: CadCriteria{NegatedQuery: "urgent important"}, want: "-{urgent important}"},
+		{name: "has attachment", criteria: CadCriteria{HasAttachment: true}, want: "has:attachment"},
+		{name: "exclude chats", criteria: CadCriteria{ExcludeChats: true}, want: "-in:chats"},
+		{name: "larger", criteria: CadCriteria{Size: 1048576, SizeComparison: "larger"}, want: "larger:1048576"},
+		{name: "smaller", criteria: CadCriteria{Size: 2048, SizeComparison: "SMALLER"}, want: "smaller:2048"},
+		{name: "size without comparison", criteria: CadCriteria{Size: 2048}, want: ""},
+		{name: "comparison without size", criteria: CadCriteria{SizeComparison: "larger"}, want: ""},
+		{
+			name: "every field",
+			criteria: CadCriteria{
+				From:           "a@x.com",
+				To:             "me@x.com",
+				Subject:        "weekly digest",
+				Query:          "list:news.x.com",
+				NegatedQuery:   "urgent",
+				HasAttachment:  true,
+				ExcludeChats:   true,
+				Size:           100,
+				SizeComparison: "larger",
+			},
+			want: "from:a@x.com to:me@x.com subject:(weekly digest) list:news.x.com -{urgent} has:attachment -in:chats larger:100",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := CriteriaQuery(tt.criteria)
+			if got != tt.want {
+				t.Errorf("CriteriaQuery() = %q, want %q", got, tt.want)
+			}
+			if got == "" {
+				return
+			}
+			if _, err := ParseQuery(got); err != nil {
+				t.Errorf("ParseQuery(%q) error = %v", got, err)
+			}
+		})
+	}
+}
+
+func TestCriteriaKey(t *testing.T) {
+	tests := []struct {
+		name string
+		a    CadCriteria
+		b    CadCriteria
+		same bool
+	}{
+		{name: "case and spacing", a: CadCriteria{From: "A@x.com"}, b: CadCriteria{From: " a@x.com "}, same: true},
+		{name: "OR order", a: CadCriteria{From: "a@x.com OR b@x.com"}, b: CadCriteria{From: "b@x.com OR a@x.com"}, same: true},
+		{name: "subject", a: CadCriteria{From: "a@x.com", Subject: "invoice"}, b: CadCriteria{From: "a@x.com", Subject: "receipt"}, same: false},
+		{name: "subject only on one side", a: CadCriteria{From: "a@x.com", Subject: "invoice"}, b: CadCriteria{From: "a@x.com"}, same: false},
+		{name: "size", a: CadCriteria{Size: 1, SizeComparison: "larger"}, b: CadCriteria{Size: 2, SizeComparison: "larger"}, same: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := CriteriaKey(tt.a), CriteriaKey(tt.b)
+			if (a == b) != tt.same {
+				t.Errorf("CriteriaKey() = %q and %q, want same %v", a, b, tt.same)
+			}
+		})
+	}
+}
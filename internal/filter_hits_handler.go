@@ -0,0 +1,153 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"time"
+)
+
+const filterhitsdatafile string = "data/filter_hits.json"
+
+// Cached searches younger than this are reused instead of searching again
+const filterHitsMaxAge time.Duration = 24 * time.Hour
+
+// CadFilterHits records whether a filter matched mail in the last days. The search
+// stops at the first match, so Seen is false for a dead filter and true otherwise.
+// Entries cached before Seen existed have it nil and are searched again.
+type CadFilterHits struct {
+	FilterId  string    `json:"filterId"`
+	Query     string    `json:"query"`
+	Days      int       `json:"days"`
+	Seen      *bool     `json:"seen,omitempty"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+// DeadFilters returns the local filters that have not matched any message in the last days
+func DeadFilters(days int) ([]CadFilter, error) {
+	filters, err := ReadLocalFilters()
+	if err != nil {
+		log.Printf("Unable to read local filters file: %v", err)
+		return nil, err
+	}
+
+	hits, err := ReadLocalFilterHits()
+	if err != nil {
+		log.Printf("Unable to read local filter hits: %v", err)
+		return nil, err
+	}
+
+	deadFilters := []CadFilter{}
+	for _, filter := range filters {
+		if filter.Criteria == nil {
+			continue
+		}
+
+		filterHits, err := countFilterHits(filter, days, hits)
+		if err != nil {
+			log.Printf("Unable to count hits for filter %s: %v", filter.Id, err)
+			// Keep the filters already searched for the next run
+			SaveLocalFilterHits(hits)
+			return nil, err
+		}
+		if filterHits == nil {
+			// Criteria without a search query equivalent can not be checked
+			continue
+		}
+		hits[filter.Id] = *filterHits
+
+		if !*filterHits.Seen {
+			deadFilters = append(deadFilters, filter)
+		}
+	}
+
+	if err := SaveLocalFilterHits(hits); err != nil {
+		return nil, err
+	}
+
+	return deadFilters, nil
+}
+
+// countFilterHits checks whether the filter matched any mail in the last days, or
+// returns nil when the criteria translate to an empty query
+func countFilterHits(filter CadFilter, days int, cache map[string]CadFilterHits) (*CadFilterHits, error) {
+	query := CriteriaQuery(*filter.Criteria)
+	if query == "" {
+		return nil, nil
+	}
+
+	cached, ok := cache[filter.Id]
+	if ok && cached.Seen != nil && cached.Query == query && cached.Days == days && time.Since(cached.CheckedAt) < filterHitsMaxAge {
+		return &cached, nil
+	}
+
+	fmt.Printf("\tSearching for filter ID %s\n", filter.Id)
+	srv, err := GetService()
+	if err != nil {
+		log.Printf("Unable to retrieve Gmail client: %v", err)
+		return nil, err
+	}
+
+	// A single result is enough to know the filter is alive. Filters which trash mail
+	// or send it to spam only match there.
+	user := "me"
+	q := fmt.Sprintf("(%s) newer_than:%dd", query, days)
+	r, err := srv.Users.Messages.List(user).Q(q).IncludeSpamTrash(true).MaxResults(1).Do()
+	if err != nil {
+		log.Printf("Unable to retrieve messages: %v", err)
+		return nil, err
+	}
+
+	seen := len(r.Messages) > 0
+	return &CadFilterHits{
+		FilterId:  filter.Id,
+		Query:     query,
+		Days:      days,
+		Seen:      &seen,
+		CheckedAt: time.Now().UTC(),
+	}, nil
+}
+
+// DeadFilterMigrations proposes deleting each of the dead filters
+func DeadFilterMigrations(filters []CadFilter, days int) []CadRawMigration {
+	migrations := []CadRawMigration{}
+	for _, filter := range filters {
+		migration := deleteFilterSuggestion(filter, fmt.Sprintf("Dead filter with no matches in %d days identified by the doctor", days))
+		migrations = append(migrations, *migration)
+	}
+	return migrations
+}
+
+func SaveLocalFilterHits(hits map[string]CadFilterHits) error {
+	b, err := json.MarshalIndent(hits, "", "  ")
+	if err != nil {
+		log.Printf("Unable to marshal filter hits: %v", err)
+		return err
+	}
+
+	err = ioutil.WriteFile(filterhitsdatafile, b, 0664)
+	if err != nil {
+		log.Printf("Unable to persist filter hits: %v", err)
+		return err
+	}
+	return nil
+}
+
+func ReadLocalFilterHits() (map[string]CadFilterHits, error) {
+	if !fileExists(filterhitsdatafile) {
+		return map[string]CadFilterHits{}, nil
+	}
+
+	b, err := ioutil.ReadFile(filterhitsdatafile)
+	if err != nil {
+		log.Printf("Unable to read local filter hits data file: %v", err)
+		return nil, err
+	}
+	hits := map[string]CadFilterHits{}
+	if err := json.Unmarshal(b, &hits); err != nil {
+		return map[string]CadFilterHits{}, err
+	}
+
+	return hits, nil
+}
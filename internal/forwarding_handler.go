@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+const forwardingdatafile string = "data/forwarding.json"
+const forwardingAccepted string = "accepted"
+
+type CadForwardingAddress struct {
+	ForwardingEmail    string `json:"forwardingEmail,omitempty"`
+	VerificationStatus string `json:"verificationStatus,omitempty"`
+}
+
+func GetForwardingAddresses() ([]*CadForwardingAddress, error) {
+	srv, err := GetService()
+	if err != nil {
+		log.Printf("Unable to retrieve Gmail client: %v", err)
+		return nil, err
+	}
+
+	user := "me"
+	r, err := srv.Users.Settings.ForwardingAddresses.List(user).Do()
+	if err != nil {
+		log.Printf("Unable to retrieve forwarding addresses: %v", err)
+		return nil, err
+	}
+
+	addresses := []*CadForwardingAddress{}
+	for _, address := range r.ForwardingAddresses {
+		addresses = append(addresses, MarshalCadForwardingAddress(address))
+	}
+	sort.SliceStable(addresses, func(i, j int) bool {
+		return addresses[i].ForwardingEmail < addresses[j].ForwardingEmail
+	})
+
+	return addresses, nil
+}
+
+// CreateForwardingAddress registers a forwarding address. Gmail sends a verification
+// mail to the address and only forwards to it once it has been accepted. Gmail only
+// allows this to service accounts with domain-wide delegation.
+func CreateForwardingAddress(email string) (*CadForwardingAddress, error) {
+	srv, err := GetService()
+	if err != nil {
+		log.Printf("Unable to retrieve Gmail client: %v", err)
+		return nil, err
+	}
+
+	user := "me"
+	address, err := srv.Users.Settings.ForwardingAddresses.Create(user, &gmail.ForwardingAddress{ForwardingEmail: email}).Do()
+	if err != nil {
+		log.Printf("Unable to create forwarding address: %v", err)
+		return nil, forwardingDelegationError(err, "add", email)
+	}
+	return MarshalCadForwardingAddress(address), nil
+}
+
+// DeleteForwardingAddress removes a forwarding address, like creating one it needs
+// domain-wide delegation
+func DeleteForwardingAddress(email string) error {
+	srv, err := GetService()
+	if err != nil {
+		log.Printf("Unable to retrieve Gmail client: %v", err)
+		return err
+	}
+
+	user := "me"
+	err = srv.Users.Settings.ForwardingAddresses.Delete(user, email).Do()
+	if err != nil {
+		log.Printf("Unable to delete forwarding address: %s\n%v", email, err)
+		return forwardingDelegationError(err, "remove", email)
+	}
+	return nil
+}
+
+// forwardingDelegationError explains the 403 Gmail returns to accounts without
+// domain-wide delegation, other errors are returned as they are
+func forwardingDelegationError(err error, verb string, email string) error {
+	if apiErr, ok := err.(*googleapi.Error); ok && apiErr.Code == http.StatusForbidden {
+		return fmt.Errorf("unable to %s forwarding address %s: Gmail only allows this with domain-wide delegation, %s it in the Gmail settings instead (%v)", verb, email, verb, err)
+	}
+	return err
+}
+
+// VerifyForwardingAddress returns an error unless Gmail has accepted the forwarding address
+func VerifyForwardingAddress(email string) error {
+	addresses, err := GetForwardingAddresses()
+	if err != nil {
+		return err
+	}
+
+	for _, address := range addresses {
+		if strings.EqualFold(address.ForwardingEmail, email) {
+			if address.VerificationStatus != forwardingAccepted {
+				return fmt.Errorf("forwarding address %s is %s, Gmail only forwards to verified addresses", email, address.VerificationStatus)
+			}
+			return nil
+		}
+	}
+
+	return fmt.Errorf("forwarding address %s is not registered, add it with a %s migration and verify it first", email, CreateForwardingAddressMigration)
+}
+
+func MarshalCadForwardingAddress(address *gmail.ForwardingAddress) *CadForwardingAddress {
+	return &CadForwardingAddress{
+		ForwardingEmail:    address.ForwardingEmail,
+		VerificationStatus: address.VerificationStatus,
+	}
+}
+
+func SaveLocalForwardingAddresses(addresses []*CadForwardingAddress) error {
+	b, err := json.MarshalIndent(addresses, "", "  ")
+	if err != nil {
+		log.Printf("Unable to marshal forwarding addresses to JSON: %v", err)
+		return err
+	}
+
+	err = ioutil.WriteFile(forwardingdatafile, b, 0664)
+	if err != nil {
+		log.Printf("Unable to persist forwarding addresses: %v", err)
+		return err
+	}
+	return nil
+}
+
+func ReadLocalForwardingAddresses() ([]CadForwardingAddress, error) {
+	if !fileExists(forwardingdatafile) {
+		return []CadForwardingAddress{}, nil
+	}
+
+	b, err := ioutil.ReadFile(forwardingdatafile)
+	if err != nil {
+		log.Printf("Unable to read local forwarding address data file: %v", err)
+		return nil, err
+	}
+	var addresses []CadForwardingAddress
+	if err := json.Unmarshal(b, &addresses); err != nil {
+		return []CadForwardingAddress{}, err
+	}
+
+	return addresses, nil
+}
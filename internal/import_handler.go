@@ -0,0 +1,427 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+const importCheckpointSuffix string = ".import-checkpoint.jsonl"
+
+const ImportStatusImported string = "imported"
+const ImportStatusSkipped string = "skipped"
+const ImportStatusFailed string = "failed"
+
+// Gmail system labels by the names used in X-Gmail-Labels headers, both the Google
+// Takeout names and the label ids written by export, lower case. An empty id drops
+// the label, eg drafts can not be imported.
+var importSystemLabels = map[string]string{
+	"inbox":               "INBOX",
+	"unread":              "UNREAD",
+	"starred":             "STARRED",
+	"important":           "IMPORTANT",
+	"sent":                "SENT",
+	"spam":                "SPAM",
+	"trash":               "TRASH",
+	"category personal":   "CATEGORY_PERSONAL",
+	"category social":     "CATEGORY_SOCIAL",
+	"category promotions": "CATEGORY_PROMOTIONS",
+	"category updates":    "CATEGORY_UPDATES",
+	"category forums":     "CATEGORY_FORUMS",
+	"category_personal":   "CATEGORY_PERSONAL",
+	"category_social":     "CATEGORY_SOCIAL",
+	"category_promotions": "CATEGORY_PROMOTIONS",
+	"category_updates":    "CATEGORY_UPDATES",
+	"category_forums":     "CATEGORY_FORUMS",
+	"draft":               "",
+	"drafts":              "",
+	"chat":                "",
+	"opened":              "",
+	"archived":            "",
+	"all mail":            "",
+}
+
+// CadImportCheckpoint records a message of a source already imported, skipped as a
+// duplicate or failed, by the relative path of its file and its position in it
+type CadImportCheckpoint struct {
+	Key    string `json:"key"`
+	Status string `json:"status"`
+}
+
+type CadImportResult struct {
+	Imported int `json:"imported"`
+	Skipped  int `json:"skipped"`
+	Failed   int `json:"failed"`
+}
+
+// importItem is a message to import, read lazily from its file
+type importItem struct {
+	key    string
+	path   string
+	start  int64
+	end    int64
+	folder string
+}
+
+// ImportMessages imports the messages of an mbox file or of a directory of .eml and
+// mbox files into Gmail, keeping the date of the Date header. The labels come from the
+// X-Gmail-Labels header or else from the folder of the file, and extraLabel is added to
+// every message. Messages whose Message-ID is already in the mailbox are skipped.
+// A checkpoint next to the source lets an interrupted import resume.
+func ImportMessages(source string, extraLabel string) (*CadImportResult, error) {
+	srv, err := GetService()
+	if err != nil {
+		log.Printf("Unable to retrieve Gmail client: %v", err)
+		return nil, err
+	}
+
+	items, err := listImportItems(source)
+	if err != nil {
+		return nil, err
+	}
+
+	checkpointPath := strings.TrimRight(source, string(filepath.Separator)) + importCheckpointSuffix
+	done, err := readImportCheckpoint(checkpointPath)
+	if err != nil {
+		return nil, err
+	}
+
+	resolver, err := newImportLabelResolver()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &CadImportResult{}
+	for i, item := range items {
+		if done[item.key] {
+			continue
+		}
+		fmt.Printf("Importing message %d/%d (%d imported, %d skipped, %d failed)\n", i+1, len(items), result.Imported, result.Skipped, result.Failed)
+
+		status, err := importMessage(srv, resolver, item, extraLabel)
+		if err != nil {
+			return result, err
+		}
+		switch status {
+		case ImportStatusImported:
+			result.Imported++
+		case ImportStatusSkipped:
+			result.Skipped++
+		case ImportStatusFailed:
+			result.Failed++
+		}
+
+		if err := appendCheckpoint(checkpointPath, CadImportCheckpoint{Key: item.key, Status: status}); err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+// importMessage imports a message unless its Message-ID is already in the mailbox. A
+// message which can not be parsed is reported as failed, errors are left for the API
+// and the files.
+func importMessage(srv *gmail.Service, resolver *importLabelResolver, item importItem, extraLabel string) (string, error) {
+	raw, err := item.read()
+	if err != nil {
+		log.Printf("Unable to read message %s: %v", item.key, err)
+		return "", err
+	}
+	message, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		log.Printf("Unable to parse message %s, skipping it: %v", item.key, err)
+		return ImportStatusFailed, nil
+	}
+
+	user := "me"
+	if messageId := strings.Trim(message.Header.Get("Message-ID"), " <>"); messageId != "" {
+		// A message in the trash or spam is already in the mailbox too
+		r, err := srv.Users.Messages.List(user).
+			Q("rfc822msgid:" + messageId).
+			IncludeSpamTrash(true).
+			MaxResults(1).
+			Do()
+		if err != nil {
+			log.Printf("Unable to retrieve messages: %v", err)
+			return "", err
+		}
+		if len(r.Messages) > 0 {
+			return ImportStatusSkipped, nil
+		}
+	}
+
+	names := []string{}
+	if header := message.Header.Get(gmailLabelsHeader); header != "" {
+		names = parseGmailLabels(header)
+	} else if item.folder != "" {
+		names = append(names, item.folder)
+	}
+	if extraLabel != "" {
+		names = append(names, extraLabel)
+	}
+	labelIds, err := resolver.labelIds(names)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = srv.Users.Messages.Import(user, &gmail.Message{LabelIds: labelIds}).
+		InternalDateSource("dateHeader").
+		NeverMarkSpam(true).
+		Media(bytes.NewReader(removeHeader(raw, gmailLabelsHeader)), googleapi.ContentType("message/rfc822")).
+		Do()
+	if err != nil {
+		log.Printf("Unable to import message %s: %v", item.key, err)
+		return "", err
+	}
+	return ImportStatusImported, nil
+}
+
+// readImportCheckpoint returns the keys of the messages already handled by a previous
+// run, whether imported, skipped or failed
+func readImportCheckpoint(path string) (map[string]bool, error) {
+	done := map[string]bool{}
+	err := readCheckpoint(path, func(line []byte) error {
+		record := CadImportCheckpoint{}
+		if err := json.Unmarshal(line, &record); err != nil {
+			return err
+		}
+		done[record.Key] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return done, nil
+}
+
+// listImportItems lists the messages of an mbox or .eml file, or of the .eml and .mbox
+// files in a directory and its subdirectories. The folder of a message is the directory
+// of its .eml file, or the path of its mbox file without the extension, relative to
+// source.
+func listImportItems(source string) ([]importItem, error) {
+	info, err := os.Stat(source)
+	if err != nil {
+		log.Printf("Unable to read import source: %v", err)
+		return nil, err
+	}
+	if !info.IsDir() {
+		if strings.ToLower(filepath.Ext(source)) == ".eml" {
+			return []importItem{{key: filepath.Base(source), path: source, start: 0, end: info.Size()}}, nil
+		}
+		return mboxImportItems(source, filepath.Base(source), "")
+	}
+
+	items := []importItem{}
+	err = filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".eml":
+			folder := filepath.ToSlash(filepath.Dir(rel))
+			if folder == "." {
+				folder = ""
+			}
+			items = append(items, importItem{key: rel, path: path, start: 0, end: info.Size(), folder: folder})
+		case ".mbox", ".mbx":
+			mboxItems, err := mboxImportItems(path, rel, strings.TrimSuffix(rel, filepath.Ext(rel)))
+			if err != nil {
+				return err
+			}
+			items = append(items, mboxItems...)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Unable to list import source: %v", err)
+		return nil, err
+	}
+
+	sort.SliceStable(items, func(i, j int) bool { return items[i].path < items[j].path })
+	return items, nil
+}
+
+// mboxImportItems scans an mbox file for the offsets of its messages. A line starting
+// with "From " separates messages when it is the first line or follows a blank line.
+func mboxImportItems(path string, key string, folder string) ([]importItem, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Printf("Unable to open mbox file: %v", err)
+		return nil, err
+	}
+	defer f.Close()
+
+	items := []importItem{}
+	reader := bufio.NewReader(f)
+	offset := int64(0)
+	previousBlank := true
+	for {
+		line, err := reader.ReadString('\n')
+		if len(line) > 0 {
+			if previousBlank && strings.HasPrefix(line, "From ") {
+				if len(items) > 0 {
+					items[len(items)-1].end = offset
+				}
+				start := offset + int64(len(line))
+				items = append(items, importItem{
+					key:    fmt.Sprintf("%s#%d", key, len(items)+1),
+					path:   path,
+					start:  start,
+					end:    start,
+					folder: folder,
+				})
+			}
+			previousBlank = strings.TrimRight(line, "\r\n") == ""
+			offset += int64(len(line))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("Unable to read mbox file: %v", err)
+			return nil, err
+		}
+	}
+	if len(items) > 0 {
+		items[len(items)-1].end = offset
+	}
+
+	return items, nil
+}
+
+// read returns the message, unquoting the From lines of mbox messages
+func (item importItem) read() ([]byte, error) {
+	f, err := os.Open(item.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	raw := make([]byte, item.end-item.start)
+	if _, err := f.ReadAt(raw, item.start); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if strings.ToLower(filepath.Ext(item.path)) == ".eml" {
+		return raw, nil
+	}
+
+	lines := strings.SplitAfter(string(raw), "\n")
+	for i, line := range lines {
+		if regMboxFrom.MatchString(line) && strings.HasPrefix(line, ">") {
+			lines[i] = line[1:]
+		}
+	}
+	// Drop the blank line separating the message from the next one
+	return []byte(strings.TrimRight(strings.Join(lines, ""), "\r\n") + "\n"), nil
+}
+
+// parseGmailLabels splits an X-Gmail-Labels header, which separates the label names
+// with commas and quotes names containing one
+func parseGmailLabels(header string) []string {
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(header); err == nil {
+		header = decoded
+	}
+	reader := csv.NewReader(strings.NewReader(header))
+	reader.LazyQuotes = true
+	reader.TrimLeadingSpace = true
+	fields, err := reader.Read()
+	if err != nil {
+		fields = strings.Split(header, ",")
+	}
+
+	names := []string{}
+	for _, field := range fields {
+		if name := strings.TrimSpace(field); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// removeHeader drops a header and its continuation lines from a raw message
+func removeHeader(raw []byte, name string) []byte {
+	end := bytes.Index(raw, []byte("\n\n"))
+	if crlfEnd := bytes.Index(raw, []byte("\r\n\r\n")); crlfEnd >= 0 && (end < 0 || crlfEnd < end) {
+		end = crlfEnd
+	}
+	if end < 0 {
+		return raw
+	}
+
+	prefix := strings.ToLower(name) + ":"
+	kept := []string{}
+	removing := false
+	for _, line := range strings.SplitAfter(string(raw[:end]), "\n") {
+		continuation := strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")
+		if !continuation {
+			removing = strings.HasPrefix(strings.ToLower(line), prefix)
+		}
+		if !removing {
+			kept = append(kept, line)
+		}
+	}
+	return append([]byte(strings.Join(kept, "")), raw[end:]...)
+}
+
+// importLabelResolver maps label names to label ids, creating the missing user labels
+type importLabelResolver struct {
+	ids map[string]string
+}
+
+func newImportLabelResolver() (*importLabelResolver, error) {
+	labels, err := GetLabels()
+	if err != nil {
+		log.Printf("Unable to retrieve labels: %v", err)
+		return nil, err
+	}
+
+	resolver := &importLabelResolver{ids: map[string]string{}}
+	for _, label := range labels {
+		resolver.ids[strings.ToLower(label.Name)] = label.Id
+	}
+	return resolver, nil
+}
+
+func (resolver *importLabelResolver) labelIds(names []string) ([]string, error) {
+	labelIds := []string{}
+	for _, name := range names {
+		key := strings.ToLower(name)
+		id, ok := importSystemLabels[key]
+		if !ok {
+			id, ok = resolver.ids[key]
+		}
+		if !ok {
+			label, err := CreateUserLabel(&CadLabel{Name: name})
+			if err != nil {
+				return nil, err
+			}
+			fmt.Printf("%sCreated label %s\n", indent, label.Name)
+			id = label.Id
+			resolver.ids[key] = id
+		}
+		if id != "" && !contains(labelIds, id) {
+			labelIds = append(labelIds, id)
+		}
+	}
+	return labelIds, nil
+}
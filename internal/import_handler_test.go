@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/mail"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMboxImportItems(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "old.mbox")
+	mbox := "From a@x.com Mon Jan  3 10:00:00 2022\n" +
+		"Message-ID: <1@x.com>\nSubject: first\n\nhello\n>From the start\n\n" +
+		"From b@x.com Mon Jan  3 11:00:00 2022\n" +
+		"Subject: broken\n" +
+		"no header separator\n\n" +
+		"From c@x.com Mon Jan  3 12:00:00 2022\n" +
+		"Message-ID: <3@x.com>\nSubject: third\n\nbye\n"
+	if err := ioutil.WriteFile(path, []byte(mbox), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := mboxImportItems(path, "old.mbox", "")
+	if err != nil {
+		t.Fatalf("mboxImportItems() error = %v", err)
+	}
+	keys := []string{}
+	for _, item := range items {
+		keys = append(keys, item.key)
+	}
+	if want := []string{"old.mbox#1", "old.mbox#2", "old.mbox#3"}; !reflect.DeepEqual(keys, want) {
+		t.Fatalf("mboxImportItems() keys = %q, want %q", keys, want)
+	}
+
+	raw, err := items[0].read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Message-ID: <1@x.com>\nSubject: first\n\nhello\nFrom the start\n"; string(raw) != want {
+		t.Errorf("read() = %q, want %q", raw, want)
+	}
+
+	raw, err = items[1].read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+		t.Errorf("mail.ReadMessage(%q) parsed a message without a header separator", raw)
+	}
+}
+
+func TestImportCheckpointResumes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "old.mbox"+importCheckpointSuffix)
+	for _, record := range []CadImportCheckpoint{
+		{Key: "old.mbox#1", Status: ImportStatusImported},
+		{Key: "old.mbox#2", Status: ImportStatusFailed},
+	} {
+		if err := appendCheckpoint(path, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, _ := ioutil.ReadFile(path)
+	ioutil.WriteFile(path, append(b, []byte(`{"key":"old.mbox#3","sta`)...), 0664)
+
+	done, err := readImportCheckpoint(path)
+	if err != nil {
+		t.Fatalf("readImportCheckpoint() error = %v", err)
+	}
+	if want := map[string]bool{"old.mbox#1": true, "old.mbox#2": true}; !reflect.DeepEqual(done, want) {
+		t.Errorf("readImportCheckpoint() = %v, want %v", done, want)
+	}
+}
+
+func TestListImportItemsSingleEml(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "receipt.eml")
+	message := "Message-ID: <1@x.com>\nSubject: receipt\n\nFrom the shop\n"
+	if err := ioutil.WriteFile(path, []byte(message), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := listImportItems(path)
+	if err != nil {
+		t.Fatalf("listImportItems() error = %v", err)
+	}
+	if len(items) != 1 || items[0].key != "receipt.eml" {
+		t.Fatalf("listImportItems() = %+v, want the single message", items)
+	}
+	raw, err := items[0].read()
+	if err != nil || string(raw) != message {
+		t.Errorf("read() = %q, %v, want %q", raw, err, message)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"sort"
+	"strings"
 
 	"google.golang.org/api/gmail/v1"
 )
@@ -91,6 +92,23 @@ func CreateUserLabel(cadLabel *CadLabel) (*CadLabel, error) {
 	return MarshalCadLabel(label), nil
 }
 
+// FindOrCreateUserLabel returns the label with the given name, creating it when it does not exist
+func FindOrCreateUserLabel(name string) (*CadLabel, error) {
+	labels, err := GetLabels()
+	if err != nil {
+		log.Printf("Unable to retrieve labels: %v", err)
+		return nil, err
+	}
+
+	for _, label := range labels {
+		if strings.EqualFold(label.Name, name) {
+			return label, nil
+		}
+	}
+
+	return CreateUserLabel(&CadLabel{Name: name})
+}
+
 func DeleteUserLabel(cadLabel *CadLabel) error {
 	srv, err := GetService()
 	if err != nil {
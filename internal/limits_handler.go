@@ -0,0 +1,166 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// Gmail account limits. Filter criteria longer than maxFilterQueryLength are rejected.
+const maxFilters int = 1000
+const maxFilterQueryLength int = 1500
+const maxLabels int = 10000
+
+const FiltersLimit string = "filters"
+const FilterQueryLengthLimit string = "filter query length"
+const LabelsLimit string = "user labels"
+
+// CadLimitUsage is the current usage of a Gmail limit, read from the local data
+// files, and the usage predicted once the pending migrations have run
+type CadLimitUsage struct {
+	Name      string `json:"name"`
+	Current   int    `json:"current"`
+	Predicted int    `json:"predicted"`
+	Limit     int    `json:"limit"`
+}
+
+func (usage CadLimitUsage) Exceeded() bool {
+	return usage.Predicted > usage.Limit
+}
+
+// PredictLimits replays the filter and label migrations in the migration files against
+// the local filters and labels. Create-filter migrations are split the same way createFilter
+// splits them, so one migration may add several filters.
+func PredictLimits(migrationFiles []string) ([]CadLimitUsage, error) {
+	filters, err := ReadLocalFilters()
+	if err != nil {
+		log.Printf("Unable to read local filters file: %v", err)
+		return nil, err
+	}
+	labels, err := ReadLocalLabels()
+	if err != nil {
+		log.Printf("Unable to read local labels file: %v", err)
+		return nil, err
+	}
+
+	labelIdToType := map[string]string{}
+	userLabelCount := 0
+	for _, label := range labels {
+		labelIdToType[label.Id] = label.Type
+		if label.Type == user {
+			userLabelCount++
+		}
+	}
+
+	filtersById := map[string]CadFilter{}
+	queryLengths := map[string]int{}
+	for _, filter := range filters {
+		filtersById[filter.Id] = filter
+		if filter.Criteria != nil {
+			queryLengths[filter.Id] = len(CriteriaQuery(*filter.Criteria))
+		}
+	}
+
+	filterUsage := CadLimitUsage{Name: FiltersLimit, Current: len(filters), Predicted: len(filters), Limit: maxFilters}
+	labelUsage := CadLimitUsage{Name: LabelsLimit, Current: userLabelCount, Predicted: userLabelCount, Limit: maxLabels}
+	queryUsage := CadLimitUsage{Name: FilterQueryLengthLimit, Current: longestQuery(queryLengths), Limit: maxFilterQueryLength}
+
+	removeFilter := func(id string) {
+		if _, ok := filtersById[id]; ok {
+			filterUsage.Predicted--
+			delete(queryLengths, id)
+		}
+	}
+	addFilters := func(key string, criteria *CadCriteria, action *CadAction) {
+		if criteria == nil || action == nil {
+			return
+		}
+		splitTypes := map[string]string{}
+		for _, labelId := range action.AddLabelIds {
+			splitTypes[labelId] = labelIdToType[labelId]
+			if _, ok := labelIdToType[labelId]; !ok && !isSystemLabelId(labelId) {
+				splitTypes[labelId] = user
+			}
+		}
+		filterUsage.Predicted += len(splitFilter(criteria, *action, splitTypes))
+		queryLengths[key] = len(CriteriaQuery(*criteria))
+	}
+
+	for _, migrationFile := range migrationFiles {
+		migrations, err := ReadMigrationFile(migrationFile)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, migration := range migrations {
+			if migration.Operation == nil {
+				continue
+			}
+			key := fmt.Sprintf("%s#%d", migrationFile, i+1)
+			b, _ := migration.RawDetails.MarshalJSON()
+
+			switch *migration.Operation {
+			case CreateFilterMigration:
+				filterMigration := CadCreateFilterMigration{}
+				json.Unmarshal(b, &filterMigration)
+				addFilters(key, filterMigration.Criteria, filterMigration.Action)
+			case DeleteFilterMigration:
+				filterMigration := CadDeleteFilterMigration{}
+				json.Unmarshal(b, &filterMigration)
+				if filterMigration.Id != nil {
+					removeFilter(*filterMigration.Id)
+				}
+			case DeleteFiltersMigration:
+				filtersMigration := CadDeleteFiltersMigration{}
+				json.Unmarshal(b, &filtersMigration)
+				if filtersMigration.Ids != nil {
+					for _, id := range *filtersMigration.Ids {
+						removeFilter(id)
+					}
+				}
+			case ReplaceFiltersMigration:
+				filterMigration := CadReplaceFiltersMigration{}
+				json.Unmarshal(b, &filterMigration)
+				if filterMigration.Ids == nil {
+					continue
+				}
+				for _, id := range *filterMigration.Ids {
+					filter, ok := filtersById[id]
+					if !ok {
+						continue
+					}
+					removeFilter(id)
+					addFilters(fmt.Sprintf("%s-%s", key, id), filter.Criteria, filterMigration.Action)
+				}
+			case CreateLabelMigration:
+				labelUsage.Predicted++
+			case DeleteLabelMigration:
+				labelUsage.Predicted--
+			}
+		}
+	}
+	queryUsage.Predicted = longestQuery(queryLengths)
+
+	return []CadLimitUsage{filterUsage, queryUsage, labelUsage}, nil
+}
+
+func longestQuery(queryLengths map[string]int) int {
+	longest := 0
+	for _, length := range queryLengths {
+		if length > longest {
+			longest = length
+		}
+	}
+	return longest
+}
+
+// isSystemLabelId reports whether a label id is one of Gmail's system labels,
+// which are upper case names such as INBOX or CATEGORY_PROMOTIONS
+func isSystemLabelId(labelId string) bool {
+	for _, r := range labelId {
+		if (r < 'A' || r > 'Z') && r != '_' {
+			return false
+		}
+	}
+	return labelId != ""
+}
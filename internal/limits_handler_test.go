@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeJSONFile(t *testing.T, path string, v interface{}) {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, b, 0664); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPredictLimits(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	writeJSONFile(t, labeldatafile, []CadLabel{
+		{Id: "INBOX", Name: "INBOX", Type: "system"},
+		{Id: "Label_1", Name: "News", Type: user},
+		{Id: "Label_2", Name: "Receipts", Type: user},
+	})
+	writeJSONFile(t, filterdatafile, []CadFilter{
+		{Id: "f1", Criteria: &CadCriteria{From: "a@x.com"}, Action: &CadAction{AddLabelIds: []string{"Label_1"}}},
+		{Id: "f2", Criteria: &CadCriteria{From: "b@x.com"}, Action: &CadAction{AddLabelIds: []string{"Label_1"}}},
+	})
+
+	longCriteria := CadCriteria{From: "c@x.com", Query: strings.Repeat("word ", 400)}
+	raw := func(operation string, details interface{}) map[string]interface{} {
+		return map[string]interface{}{"operation": operation, "details": details}
+	}
+	createFile := filepath.Join("migrations", "1_create.json")
+	writeJSONFile(t, createFile, []map[string]interface{}{
+		// Label_3 is created by the migration, so it is a user label and the filter is split in three
+		raw(CreateFilterMigration, CadCreateFilterMigration{
+			Criteria: &longCriteria,
+			Action:   &CadAction{AddLabelIds: []string{"Label_1", "Label_2", "Label_3"}, RemoveLabelIds: []string{"INBOX"}},
+		}),
+		raw(CreateLabelMigration, map[string]string{"name": "Invoices"}),
+	})
+	replaceFile := filepath.Join("migrations", "2_replace.json")
+	writeJSONFile(t, replaceFile, []map[string]interface{}{
+		raw(ReplaceFiltersMigration, map[string]interface{}{
+			"ids":    []string{"f1", "missing"},
+			"action": CadAction{AddLabelIds: []string{"Label_1", "Label_2"}},
+		}),
+		raw(DeleteFilterMigration, map[string]string{"id": "f2"}),
+		raw(DeleteFiltersMigration, map[string][]string{"ids": {"missing"}}),
+	})
+
+	usages, err := PredictLimits([]string{createFile, replaceFile})
+	if err != nil {
+		t.Fatalf("PredictLimits() error = %v", err)
+	}
+
+	queryLength := len(CriteriaQuery(longCriteria))
+	want := []CadLimitUsage{
+		{Name: FiltersLimit, Current: 2, Predicted: 2 + 3 - 1 + 2 - 1, Limit: maxFilters},
+		{Name: FilterQueryLengthLimit, Current: len(CriteriaQuery(CadCriteria{From: "a@x.com"})), Predicted: queryLength, Limit: maxFilterQueryLength},
+		{Name: LabelsLimit, Current: 2, Predicted: 3, Limit: maxLabels},
+	}
+	if len(usages) != len(want) {
+		t.Fatalf("PredictLimits() = %+v, want %+v", usages, want)
+	}
+	for i := range want {
+		if usages[i] != want[i] {
+			t.Errorf("PredictLimits()[%d] = %+v, want %+v", i, usages[i], want[i])
+		}
+		if got, exceeded := usages[i].Exceeded(), want[i].Name == FilterQueryLengthLimit; got != exceeded {
+			t.Errorf("%s Exceeded() = %v, want %v", want[i].Name, got, exceeded)
+		}
+	}
+}
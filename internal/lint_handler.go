@@ -0,0 +1,362 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"unicode"
+)
+
+const LintSeverityError string = "error"
+const LintSeverityWarning string = "warning"
+const LintSeverityOff string = "off"
+
+type CadLintIssue struct {
+	Source   string `json:"source"`
+	Subject  string `json:"subject"`
+	Rule     string `json:"rule"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// CadLintTarget is a filter or label to check, either from the local data files or
+// from a pending migration. Migration label ids may not exist locally yet.
+type CadLintTarget struct {
+	Source  string
+	Subject string
+	Filter  *CadFilter
+	Label   *CadLabel
+}
+
+type CadLintContext struct {
+	Labels map[string]CadLabel
+	Config CadLintConfig
+}
+
+// CadLintRule is a single house convention. Check returns one message per problem
+// found in the target and ignores targets it does not apply to.
+type CadLintRule interface {
+	Name() string
+	DefaultSeverity() string
+	Check(target CadLintTarget, context CadLintContext) []string
+}
+
+// LintRules are the built-in rules, run in this order
+var LintRules = []CadLintRule{
+	querySyntaxRule{},
+	archiveNeedsLabelRule{},
+	forwardDomainRule{},
+	subjectOnlyRule{},
+	labelTitleCaseRule{},
+}
+
+// Lint checks the local filters and labels and the pending migration files against
+// the lint rules, using the severities set in the config
+func Lint() ([]CadLintIssue, error) {
+	config, err := ReadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	severities, err := lintSeverities(config.Lint)
+	if err != nil {
+		return nil, err
+	}
+
+	localLabels, err := ReadLocalLabels()
+	if err != nil {
+		log.Printf("Unable to read local labels file: %v", err)
+		return nil, err
+	}
+	context := CadLintContext{Labels: map[string]CadLabel{}, Config: config.Lint}
+	for _, label := range localLabels {
+		context.Labels[label.Id] = label
+	}
+
+	targets, issues, err := lintTargets(localLabels)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(issues, lintIssues(targets, context, severities)...), nil
+}
+
+// lintSeverities returns the severity of each rule, the default one unless the config
+// sets another
+func lintSeverities(config CadLintConfig) (map[string]string, error) {
+	severities := map[string]string{}
+	for _, rule := range LintRules {
+		severities[rule.Name()] = rule.DefaultSeverity()
+	}
+	for name, severity := range config.Rules {
+		if _, ok := severities[name]; !ok {
+			return nil, fmt.Errorf("unknown lint rule %s in %s", name, configdatafile)
+		}
+		switch severity {
+		case LintSeverityError, LintSeverityWarning, LintSeverityOff:
+			severities[name] = severity
+		default:
+			return nil, fmt.Errorf("unknown severity %s for lint rule %s in %s", severity, name, configdatafile)
+		}
+	}
+	return severities, nil
+}
+
+// lintIssues runs the rules which are not off against the targets
+func lintIssues(targets []CadLintTarget, context CadLintContext, severities map[string]string) []CadLintIssue {
+	issues := []CadLintIssue{}
+	for _, target := range targets {
+		for _, rule := range LintRules {
+			severity := severities[rule.Name()]
+			if severity == LintSeverityOff {
+				continue
+			}
+			for _, message := range rule.Check(target, context) {
+				issues = append(issues, CadLintIssue{
+					Source:   target.Source,
+					Subject:  target.Subject,
+					Rule:     rule.Name(),
+					Severity: severity,
+					Message:  message,
+				})
+			}
+		}
+	}
+	return issues
+}
+
+// lintTargets collects the filters and labels to check. Migration files which cannot
+// be parsed are reported as issues rather than errors.
+func lintTargets(localLabels []CadLabel) ([]CadLintTarget, []CadLintIssue, error) {
+	targets := []CadLintTarget{}
+	issues := []CadLintIssue{}
+
+	filters, err := ReadLocalFilters()
+	if err != nil {
+		log.Printf("Unable to read local filters file: %v", err)
+		return nil, nil, err
+	}
+	for i := range filters {
+		targets = append(targets, CadLintTarget{Source: filterdatafile, Subject: filters[i].Id, Filter: &filters[i]})
+	}
+	for i := range localLabels {
+		if localLabels[i].Type == user {
+			targets = append(targets, CadLintTarget{Source: labeldatafile, Subject: localLabels[i].Id, Label: &localLabels[i]})
+		}
+	}
+
+	migrationFiles, err := PendingMigrationFiles()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, migrationFile := range migrationFiles {
+		migrations, err := ReadMigrationFile(migrationFile)
+		if err != nil {
+			issues = append(issues, CadLintIssue{
+				Source:   migrationFile,
+				Rule:     "migration-syntax",
+				Severity: LintSeverityError,
+				Message:  fmt.Sprintf("unable to parse: %v", err),
+			})
+			continue
+		}
+
+		for i, migration := range migrations {
+			if migration.Operation == nil {
+				continue
+			}
+			target := CadLintTarget{Source: migrationFile, Subject: fmt.Sprintf("#%d %s", i+1, *migration.Operation)}
+			b, _ := migration.RawDetails.MarshalJSON()
+
+			switch *migration.Operation {
+			case CreateFilterMigration:
+				filterMigration := CadCreateFilterMigration{}
+				json.Unmarshal(b, &filterMigration)
+				target.Filter = &CadFilter{Criteria: filterMigration.Criteria, Action: filterMigration.Action}
+			case ApplyFilterMigration:
+				filterMigration := CadApplyFilterMigration{}
+				json.Unmarshal(b, &filterMigration)
+				if filterMigration.Criteria == nil {
+					continue
+				}
+				target.Filter = &CadFilter{Criteria: filterMigration.Criteria, Action: filterMigration.Action}
+			case UpdateMessagesMigration:
+				messageMigration := CadUpdateMessagesMigration{}
+				json.Unmarshal(b, &messageMigration)
+				if messageMigration.QueryString == nil {
+					continue
+				}
+				target.Filter = &CadFilter{Criteria: &CadCriteria{Query: *messageMigration.QueryString}}
+			case TrashMessagesMigration, UntrashMessagesMigration, DeleteMessagesMigration:
+				messagesMigration := CadMessagesMigration{}
+				json.Unmarshal(b, &messagesMigration)
+				if messagesMigration.QueryString == nil {
+					continue
+				}
+				target.Filter = &CadFilter{Criteria: &CadCriteria{Query: *messagesMigration.QueryString}}
+			case CreateLabelMigration:
+				labelMigration := CadCreateLabelMigration{}
+				json.Unmarshal(b, &labelMigration)
+				if labelMigration.Name == nil {
+					continue
+				}
+				target.Label = &CadLabel{Name: *labelMigration.Name, Type: user}
+			case UpdateLabelMigration:
+				labelMigration := CadUpdateLabelMigration{}
+				json.Unmarshal(b, &labelMigration)
+				if labelMigration.Name == nil {
+					continue
+				}
+				target.Label = &CadLabel{Name: *labelMigration.Name, Type: user}
+			default:
+				continue
+			}
+			targets = append(targets, target)
+		}
+	}
+
+	return targets, issues, nil
+}
+
+// isUserLabelId treats labels missing from the local labels file as user labels
+// when they have a user label id, since migrations may reference new labels
+func (context CadLintContext) isUserLabelId(labelId string) bool {
+	if label, ok := context.Labels[labelId]; ok {
+		return label.Type == user
+	}
+	return strings.HasPrefix(labelId, "Label_")
+}
+
+// querySyntaxRule reports syntax errors and unknown operators in filter queries
+type querySyntaxRule struct{}
+
+func (querySyntaxRule) Name() string            { return "query-syntax" }
+func (querySyntaxRule) DefaultSeverity() string { return LintSeverityError }
+
+func (querySyntaxRule) Check(target CadLintTarget, context CadLintContext) []string {
+	if target.Filter == nil || target.Filter.Criteria == nil {
+		return nil
+	}
+
+	criteria := target.Filter.Criteria
+	fields := []struct {
+		name  string
+		value string
+	}{
+		{"from", criteria.From},
+		{"to", criteria.To},
+		{"subject", criteria.Subject},
+		{"query", criteria.Query},
+		{"negativeQuery", criteria.NegatedQuery},
+	}
+
+	messages := []string{}
+	for _, field := range fields {
+		if field.value == "" {
+			continue
+		}
+		for _, problem := range LintQuery(field.value) {
+			messages = append(messages, fmt.Sprintf("%s %s", field.name, problem))
+		}
+	}
+	return messages
+}
+
+// archiveNeedsLabelRule requires filters which skip the inbox to apply a user label,
+// otherwise the mail can only be found by searching
+type archiveNeedsLabelRule struct{}
+
+func (archiveNeedsLabelRule) Name() string            { return "archive-needs-label" }
+func (archiveNeedsLabelRule) DefaultSeverity() string { return LintSeverityError }
+
+func (archiveNeedsLabelRule) Check(target CadLintTarget, context CadLintContext) []string {
+	if target.Filter == nil || target.Filter.Action == nil {
+		return nil
+	}
+
+	action := target.Filter.Action
+	if !contains(action.RemoveLabelIds, "INBOX") {
+		return nil
+	}
+	for _, labelId := range action.AddLabelIds {
+		if context.isUserLabelId(labelId) {
+			return nil
+		}
+	}
+	return []string{"archives mail without applying a user label"}
+}
+
+// forwardDomainRule restricts forwarding to the domains listed in the config.
+// It is skipped when no domains are configured.
+type forwardDomainRule struct{}
+
+func (forwardDomainRule) Name() string            { return "forward-domain" }
+func (forwardDomainRule) DefaultSeverity() string { return LintSeverityError }
+
+func (forwardDomainRule) Check(target CadLintTarget, context CadLintContext) []string {
+	if target.Filter == nil || target.Filter.Action == nil || target.Filter.Action.Forward == "" {
+		return nil
+	}
+	if len(context.Config.AllowedForwardDomains) == 0 {
+		return nil
+	}
+
+	forward := strings.ToLower(target.Filter.Action.Forward)
+	domain := forward[strings.LastIndex(forward, "@")+1:]
+	for _, allowed := range context.Config.AllowedForwardDomains {
+		allowed = strings.ToLower(allowed)
+		if domain == allowed || strings.HasSuffix(domain, "."+allowed) {
+			return nil
+		}
+	}
+	return []string{fmt.Sprintf("forwards to %s outside of %s", target.Filter.Action.Forward, strings.Join(context.Config.AllowedForwardDomains, ", "))}
+}
+
+// subjectOnlyRule flags filters matching on the subject alone, which tend to catch
+// unrelated mail
+type subjectOnlyRule struct{}
+
+func (subjectOnlyRule) Name() string            { return "subject-only" }
+func (subjectOnlyRule) DefaultSeverity() string { return LintSeverityWarning }
+
+func (subjectOnlyRule) Check(target CadLintTarget, context CadLintContext) []string {
+	if target.Filter == nil || target.Filter.Criteria == nil {
+		return nil
+	}
+
+	criteria := *target.Filter.Criteria
+	if criteria.Subject == "" {
+		return nil
+	}
+	criteria.Subject = ""
+	criteria.ExcludeChats = false
+	if CriteriaQuery(criteria) != "" {
+		return nil
+	}
+	return []string{"matches on the subject alone"}
+}
+
+// labelTitleCaseRule requires every word of each level of a user label name to
+// start with a capital letter
+type labelTitleCaseRule struct{}
+
+func (labelTitleCaseRule) Name() string            { return "label-title-case" }
+func (labelTitleCaseRule) DefaultSeverity() string { return LintSeverityWarning }
+
+func (labelTitleCaseRule) Check(target CadLintTarget, context CadLintContext) []string {
+	if target.Label == nil || target.Label.Type != user {
+		return nil
+	}
+
+	words := strings.FieldsFunc(target.Label.Name, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '/' || r == '-'
+	})
+	for _, word := range words {
+		first := []rune(word)[0]
+		if unicode.IsLetter(first) && !unicode.IsUpper(first) {
+			return []string{fmt.Sprintf("label %s is not Title Case", target.Label.Name)}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLintRules(t *testing.T) {
+	context := CadLintContext{
+		Labels: map[string]CadLabel{
+			"INBOX":     {Id: "INBOX", Name: "INBOX", Type: "system"},
+			"Label_1":   {Id: "Label_1", Name: "News", Type: user},
+			"IMPORTANT": {Id: "IMPORTANT", Name: "IMPORTANT", Type: "system"},
+		},
+		Config: CadLintConfig{AllowedForwardDomains: []string{"example.com"}},
+	}
+	filter := func(criteria CadCriteria, action CadAction) CadLintTarget {
+		return CadLintTarget{Source: "filters", Subject: "f", Filter: &CadFilter{Criteria: &criteria, Action: &action}}
+	}
+	label := func(name string) CadLintTarget {
+		return CadLintTarget{Source: "labels", Subject: "l", Label: &CadLabel{Name: name, Type: user}}
+	}
+
+	tests := []struct {
+		name   string
+		target CadLintTarget
+		want   map[string][]string
+	}{
+		{
+			name:   "clean filter",
+			target: filter(CadCriteria{From: "a@x.com"}, CadAction{AddLabelIds: []string{"Label_1"}, RemoveLabelIds: []string{"INBOX"}}),
+			want:   map[string][]string{},
+		},
+		{
+			name:   "query syntax",
+			target: filter(CadCriteria{From: "(a@x.com", Query: "sender:b"}, CadAction{AddLabelIds: []string{"Label_1"}}),
+			want: map[string][]string{"query-syntax": {
+				`from syntax error: missing ")" for group opened at position 0`,
+				"query unknown operator sender:",
+			}},
+		},
+		{
+			name:   "archive with a system label only",
+			target: filter(CadCriteria{From: "a@x.com"}, CadAction{AddLabelIds: []string{"IMPORTANT"}, RemoveLabelIds: []string{"INBOX"}}),
+			want:   map[string][]string{"archive-needs-label": {"archives mail without applying a user label"}},
+		},
+		{
+			name:   "archive with a label created by a migration",
+			target: filter(CadCriteria{From: "a@x.com"}, CadAction{AddLabelIds: []string{"Label_99"}, RemoveLabelIds: []string{"INBOX"}}),
+			want:   map[string][]string{},
+		},
+		{
+			name:   "forward to an allowed subdomain",
+			target: filter(CadCriteria{From: "a@x.com"}, CadAction{Forward: "me@mail.example.com"}),
+			want:   map[string][]string{},
+		},
+		{
+			name:   "forward outside the allowed domains",
+			target: filter(CadCriteria{From: "a@x.com"}, CadAction{Forward: "me@notexample.com"}),
+			want:   map[string][]string{"forward-domain": {"forwards to me@notexample.com outside of example.com"}},
+		},
+		{
+			name:   "subject only",
+			target: filter(CadCriteria{Subject: "invoice", ExcludeChats: true}, CadAction{AddLabelIds: []string{"Label_1"}}),
+			want:   map[string][]string{"subject-only": {"matches on the subject alone"}},
+		},
+		{
+			name:   "title case label",
+			target: label("Work/Big Project 2022"),
+			want:   map[string][]string{},
+		},
+		{
+			name:   "lower case label level",
+			target: label("Work/big-project"),
+			want:   map[string][]string{"label-title-case": {"label Work/big-project is not Title Case"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := map[string][]string{}
+			for _, rule := range LintRules {
+				if messages := rule.Check(tt.target, context); len(messages) > 0 {
+					got[rule.Name()] = messages
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Check() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLintSeverities(t *testing.T) {
+	severities, err := lintSeverities(CadLintConfig{Rules: map[string]string{
+		"subject-only":     LintSeverityError,
+		"label-title-case": LintSeverityOff,
+	}})
+	if err != nil {
+		t.Fatalf("lintSeverities() error = %v", err)
+	}
+	want := map[string]string{
+		"query-syntax":        LintSeverityError,
+		"archive-needs-label": LintSeverityError,
+		"forward-domain":      LintSeverityError,
+		"subject-only":        LintSeverityError,
+		"label-title-case":    LintSeverityOff,
+	}
+	if !reflect.DeepEqual(severities, want) {
+		t.Errorf("lintSeverities() = %v, want %v", severities, want)
+	}
+
+	criteria := CadCriteria{Subject: "invoice"}
+	targets := []CadLintTarget{
+		{Source: "filters", Subject: "f", Filter: &CadFilter{Criteria: &criteria, Action: &CadAction{}}},
+		{Source: "labels", Subject: "l", Label: &CadLabel{Name: "lower", Type: user}},
+	}
+	issues := lintIssues(targets, CadLintContext{Labels: map[string]CadLabel{}}, severities)
+	if len(issues) != 1 || issues[0].Rule != "subject-only" || issues[0].Severity != LintSeverityError {
+		t.Errorf("lintIssues() = %+v, want one subject-only error", issues)
+	}
+
+	for _, rules := range []map[string]string{
+		{"no-such-rule": LintSeverityError},
+		{"subject-only": "fatal"},
+	} {
+		if _, err := lintSeverities(CadLintConfig{Rules: rules}); err == nil {
+			t.Errorf("lintSeverities(%v) accepted an invalid config", rules)
+		}
+	}
+}
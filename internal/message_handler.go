@@ -1,12 +1,15 @@
 package internal
 
 import (
+	"bytes"
 	"encoding/base64"
-	"errors"
 	"fmt"
 	"log"
-	"reflect"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 
@@ -15,11 +18,18 @@ import (
 
 const bulkLimit int = 1000
 
+// CadCriteraAndSampleMessage is a suggested unsubscribe. Count is the number of messages
+// found for the criteria and Subjects holds a few of their subjects.
 type CadCriteraAndSampleMessage struct {
-	Criteria      *CadCriteria
-	SampleMessage *gmail.Message
+	Criteria        *CadCriteria
+	SampleMessage   *gmail.Message
+	Count           int
+	Subjects        []string
+	UnsubscribeLink string
 }
 
+const maxSampleSubjects int = 3
+
 func GetMessageCriteriaForUnsubscribe(until time.Time) ([]*CadCriteraAndSampleMessage, error) {
 	srv, err := GetService()
 	if err != nil {
@@ -27,6 +37,11 @@ func GetMessageCriteriaForUnsubscribe(until time.Time) ([]*CadCriteraAndSampleMe
 		return nil, err
 	}
 
+	store, err := ReadLocalMessageStore()
+	if err != nil {
+		return nil, err
+	}
+
 	user := "me"
 	messageSearchCriteria := map[string]*CadCriteraAndSampleMessage{}
 	moreResults := true
@@ -44,67 +59,59 @@ func GetMessageCriteriaForUnsubscribe(until time.Time) ([]*CadCriteraAndSampleMe
 			return nil, err
 		}
 		for _, messageFragment := range r.Messages {
-			// Previously tried Regex
-			// <a.*?href.*?>[\S]*?[uU]nsubscribe[^<]?<\/a>
-			// <a.*?href.*?>[\S]*?[uU]nsubscribe[\S]*?<\/a>
-			// <a.*?href.*?>[\S]*?[uU]nsubscribe[\S\W]*?<\/a>
-			regUnsubscribe, _ := regexp.Compile(`<a.*?href.*?>[\S\W]*?[uU]nsubscribe[\S\W]*?<\/a>`)
+			criteria := &CadCriteria{}
+
+			// Messages in the local store with a List-Unsubscribe header need no body scan
+			if meta, ok := store.Messages[messageFragment.Id]; ok && meta.Header("List-Unsubscribe") != "" {
+				message := meta.GmailMessage()
+				for _, header := range message.Payload.Headers {
+					extractCriteriaFromHeader(header, criteria)
+				}
+				addUnsubscribeCriteria(messageSearchCriteria, criteria, message, "")
+				continue
+			}
+
 			message, err := srv.Users.Messages.Get(user, messageFragment.Id).Format("full").Do()
 			if err != nil {
 				log.Printf("Unable to retrieve message: %s %v", messageFragment.Id, err)
 				return nil, err
 			}
 
-			criteria := &CadCriteria{}
-			for _, part := range message.Payload.Parts {
-				if part.MimeType == "text/html" {
-					data, _ := base64.URLEncoding.DecodeString(part.Body.Data)
-					html := string(data)
-					if regUnsubscribe.MatchString(html) {
-						for _, header := range message.Payload.Headers {
-							headerNamesMap[strings.ToLower(header.Name)] = true
-							extractCriteriaFromHeader(header, criteria)
-						}
-					} else {
-						// fmt.Println(html)
-						messageIdentifiers := ""
-						for _, header := range message.Payload.Headers {
-							switch strings.ToLower(header.Name) {
-							case "from":
-								from := extractSenderFromHeader(header)
-								messageIdentifiers = fmt.Sprintf("from: %s %s", from, messageIdentifiers)
-							case "to":
-								messageIdentifiers = fmt.Sprintf("to: %s %s", header.Value, messageIdentifiers)
-							case "list-id":
-								listId := extractListIdFromHeader(header)
-								messageIdentifiers = fmt.Sprintf("listId: %s %s", listId, messageIdentifiers)
-							}
-						}
-						fmt.Printf("\t-> Message with unsubscribe missed by regex %s\n", messageIdentifiers)
-					}
-				} else if part.MimeType == "text/plain" {
-					// fmt.Printf("Skipping plain text message\n")
-				} else {
-					fmt.Printf("\t-> Message found of type %s\n", part.MimeType)
+			// As for the stored messages, the List-Unsubscribe header is enough and its
+			// link is preferred, the body is only scanned for messages without one
+			link := ListUnsubscribeFromHeaders(message.Payload.Headers).Link()
+			if link == "" {
+				content, err := ReadMessageContent(srv, message, false)
+				if err != nil {
+					return nil, err
 				}
-			}
-			if criteria.Query != "" {
-				messageSearchCriteria["Query: "+criteria.Query] = &CadCriteraAndSampleMessage{
-					Criteria:      criteria,
-					SampleMessage: message,
+				if links := ExtractUnsubscribeLinks(content); len(links) > 0 {
+					link = links[0]
 				}
-			} else if criteria.From != "" {
-				messageSearchCriteria["From: "+criteria.From] = &CadCriteraAndSampleMessage{
-					Criteria:      criteria,
-					SampleMessage: message,
+			}
+
+			if link != "" {
+				for _, header := range message.Payload.Headers {
+					headerNamesMap[strings.ToLower(header.Name)] = true
+					extractCriteriaFromHeader(header, criteria)
 				}
-			} else if criteria.To != "" {
-				messageSearchCriteria["To: "+criteria.To] = &CadCriteraAndSampleMessage{
-					Criteria:      criteria,
-					SampleMessage: message,
+			} else {
+				messageIdentifiers := ""
+				for _, header := range message.Payload.Headers {
+					switch strings.ToLower(header.Name) {
+					case "from":
+						from := extractSenderFromHeader(header)
+						messageIdentifiers = fmt.Sprintf("from: %s %s", from, messageIdentifiers)
+					case "to":
+						messageIdentifiers = fmt.Sprintf("to: %s %s", header.Value, messageIdentifiers)
+					case "list-id":
+						listId := extractListIdFromHeader(header)
+						messageIdentifiers = fmt.Sprintf("listId: %s %s", listId, messageIdentifiers)
+					}
 				}
+				fmt.Printf("\t-> Message with unsubscribe but no unsubscribe link %s\n", messageIdentifiers)
 			}
-
+			addUnsubscribeCriteria(messageSearchCriteria, criteria, message, link)
 		}
 		// headerNameKeys := []string{}
 		// for headerName := range headerNamesMap {
@@ -124,9 +131,56 @@ func GetMessageCriteriaForUnsubscribe(until time.Time) ([]*CadCriteraAndSampleMe
 	for _, value := range messageSearchCriteria {
 		criteria = append(criteria, value)
 	}
+	sort.SliceStable(criteria, func(i, j int) bool {
+		if criteria[i].Count != criteria[j].Count {
+			return criteria[i].Count > criteria[j].Count
+		}
+		return CriteriaKey(*criteria[i].Criteria) < CriteriaKey(*criteria[j].Criteria)
+	})
 	return criteria, nil
 }
 
+// addUnsubscribeCriteria groups the message under its list id, sender or recipient.
+// The List-Unsubscribe header is preferred over a link found in the body.
+func addUnsubscribeCriteria(messageSearchCriteria map[string]*CadCriteraAndSampleMessage, criteria *CadCriteria, message *gmail.Message, link string) {
+	key := ""
+	if criteria.Query != "" {
+		key = "Query: " + criteria.Query
+	} else if criteria.From != "" {
+		key = "From: " + criteria.From
+	} else if criteria.To != "" {
+		key = "To: " + criteria.To
+	} else {
+		return
+	}
+
+	subject := ""
+	for _, header := range message.Payload.Headers {
+		if strings.EqualFold(header.Name, "subject") {
+			subject = header.Value
+		}
+	}
+	if headerLink := ListUnsubscribeFromHeaders(message.Payload.Headers).Link(); headerLink != "" {
+		link = headerLink
+	}
+
+	suggestion, ok := messageSearchCriteria[key]
+	if !ok {
+		suggestion = &CadCriteraAndSampleMessage{
+			Criteria:      criteria,
+			SampleMessage: message,
+		}
+		messageSearchCriteria[key] = suggestion
+	}
+	suggestion.Count++
+	if subject != "" && len(suggestion.Subjects) < maxSampleSubjects && !contains(suggestion.Subjects, subject) {
+		suggestion.Subjects = append(suggestion.Subjects, subject)
+	}
+	if suggestion.UnsubscribeLink == "" {
+		suggestion.UnsubscribeLink = link
+	}
+}
+
 func extractCriteriaFromHeader(header *gmail.MessagePartHeader, criteria *CadCriteria) {
 	switch strings.ToLower(header.Name) {
 	case "from":
@@ -136,7 +190,7 @@ func extractCriteriaFromHeader(header *gmail.MessagePartHeader, criteria *CadCri
 		criteria.To = header.Value
 	case "list-id":
 		listId := extractListIdFromHeader(header)
-		criteria.Query = fmt.Sprintf("list:\\\"%s\\\"", listId)
+		criteria.Query = fmt.Sprintf("list:\"%s\"", listId)
 	}
 }
 
@@ -164,39 +218,21 @@ func extractSenderFromHeader(header *gmail.MessagePartHeader) string {
 	return from
 }
 
-func GetMessageIDsInInboxByFilterCriteria(filter *CadFilter) ([]string, error) {
-	labelInbox := []*CadLabel{}
-	labelInbox = append(labelInbox, &CadLabel{
-		Id: "INBOX", Name: "INBOX",
-	})
-
-	extraCriteria := false
-	q := "has:nouserlabels"
-	criteriaValue := reflect.ValueOf(filter.Criteria).Elem()
-	for i := 0; i < criteriaValue.NumField(); i++ {
-		if criteriaValue.Field(i).String() != "" {
-			switch criteriaValue.Type().Field(i).Name {
-			case "Query":
-				extraCriteria = true
-				q = fmt.Sprintf("%s \"%s\"", q, criteriaValue.Field(i))
-			case "HasAttachment":
-			case "ExcludeChats":
-			case "Size":
-			default:
-				extraCriteria = true
-				q = fmt.Sprintf("%s %s=%s", q, strings.ToLower(criteriaValue.Type().Field(i).Name), criteriaValue.Field(i))
-			}
-		}
+// GetAccountAddress returns the email address of the authenticated account
+func GetAccountAddress() (string, error) {
+	srv, err := GetService()
+	if err != nil {
+		log.Printf("Unable to retrieve Gmail client: %v", err)
+		return "", err
 	}
 
-	if !extraCriteria {
-		return nil, errors.New("no filter criteria")
+	user := "me"
+	profile, err := srv.Users.GetProfile(user).Do()
+	if err != nil {
+		log.Printf("Unable to retrieve profile: %v", err)
+		return "", err
 	}
-
-	fmt.Println(q) // TODO: Remove
-
-	returnIDs, err := GetMessagesIDsByLabelIDs(labelInbox, &q)
-	return returnIDs, err
+	return profile.EmailAddress, nil
 }
 
 func GetMessagesIDsByLabelIDs(labels []*CadLabel, query *string) ([]string, error) {
@@ -265,6 +301,141 @@ func BulkUpdateMessageLabels(messageIds []string, addLabelIds []string, removeLa
 	return nil
 }
 
+// TrashMessages moves messages to the trash, where Gmail deletes them after 30 days
+func TrashMessages(messageIds []string) error {
+	srv, err := GetService()
+	if err != nil {
+		log.Printf("Unable to retrieve Gmail client: %v", err)
+		return err
+	}
+
+	user := "me"
+	for _, messageId := range messageIds {
+		if _, err := srv.Users.Messages.Trash(user, messageId).Do(); err != nil {
+			log.Printf("Unable to trash message: %s %v", messageId, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+func UntrashMessages(messageIds []string) error {
+	srv, err := GetService()
+	if err != nil {
+		log.Printf("Unable to retrieve Gmail client: %v", err)
+		return err
+	}
+
+	user := "me"
+	for _, messageId := range messageIds {
+		if _, err := srv.Users.Messages.Untrash(user, messageId).Do(); err != nil {
+			log.Printf("Unable to untrash message: %s %v", messageId, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DeleteMessages permanently deletes messages. This needs the https://mail.google.com/
+// scope, which is authorized separately the first time.
+func DeleteMessages(messageIds []string) error {
+	srv, err := GetFullMailService()
+	if err != nil {
+		log.Printf("Unable to retrieve Gmail client: %v", err)
+		return err
+	}
+
+	for i := 0; i < len(messageIds); i += bulkLimit {
+		batchIds := messageIds[i:min(i+bulkLimit, len(messageIds))]
+		user := "me"
+
+		req := &gmail.BatchDeleteMessagesRequest{Ids: batchIds}
+
+		if err = srv.Users.Messages.BatchDelete(user, req).Do(); err != nil {
+			log.Printf("Unable to delete messages: %v", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ForwardMessage sends a copy of an existing message, attached as message/rfc822, to another address
+func ForwardMessage(messageId string, to string) error {
+	srv, err := GetService()
+	if err != nil {
+		log.Printf("Unable to retrieve Gmail client: %v", err)
+		return err
+	}
+
+	user := "me"
+	original, err := srv.Users.Messages.Get(user, messageId).Format("raw").Do()
+	if err != nil {
+		log.Printf("Unable to retrieve message: %s %v", messageId, err)
+		return err
+	}
+
+	raw, err := base64.URLEncoding.DecodeString(original.Raw)
+	if err != nil {
+		log.Printf("Unable to decode message: %s %v", messageId, err)
+		return err
+	}
+
+	subject := ""
+	if parsed, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+		subject = parsed.Header.Get("Subject")
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	fmt.Fprintf(&body, "To: %s\r\n", to)
+	fmt.Fprintf(&body, "Subject: Fwd: %s\r\n", subject)
+	fmt.Fprintf(&body, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&body, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", writer.Boundary())
+
+	text, err := writer.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(text, "Forwarded message: %s\r\n", subject)
+
+	attachment, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {"message/rfc822"},
+		"Content-Disposition": {"attachment; filename=\"forwarded.eml\""},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := attachment.Write(raw); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	return SendMessage(body.Bytes())
+}
+
+// SendMessage sends an RFC 2822 message from the account owner
+func SendMessage(raw []byte) error {
+	srv, err := GetService()
+	if err != nil {
+		log.Printf("Unable to retrieve Gmail client: %v", err)
+		return err
+	}
+
+	user := "me"
+	message := &gmail.Message{Raw: base64.URLEncoding.EncodeToString(raw)}
+	if _, err := srv.Users.Messages.Send(user, message).Do(); err != nil {
+		log.Printf("Unable to send message: %v", err)
+		return err
+	}
+
+	return nil
+}
+
 func min(a int, b int) int {
 	if a <= b {
 		return a
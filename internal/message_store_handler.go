@@ -0,0 +1,369 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+const messagestoredatafile string = "data/messages.json"
+
+// The headers kept for each message in the local message store
+var messageStoreHeaders = []string{
+	"From",
+	"To",
+	"Cc",
+	"Delivered-To",
+	"Subject",
+	"Date",
+	"List-Id",
+	"List-Unsubscribe",
+	"List-Unsubscribe-Post",
+}
+
+var errHistoryExpired = errors.New("history id is no longer available")
+
+// A full sync saves the store every so many fetched messages so it can be resumed
+const messageStoreSaveEvery int = 500
+
+// CadMessageMeta is the metadata of a message kept in the local message store.
+// InternalDate is in milliseconds since the epoch, as returned by Gmail.
+type CadMessageMeta struct {
+	Id           string            `json:"id"`
+	ThreadId     string            `json:"threadId,omitempty"`
+	LabelIds     []string          `json:"labelIds,omitempty"`
+	InternalDate int64             `json:"internalDate,omitempty"`
+	SizeEstimate int64             `json:"sizeEstimate,omitempty"`
+	Headers      map[string]string `json:"headers,omitempty"`
+}
+
+// CadMessageStore is the local copy of the message metadata of the account, without
+// the messages in the trash or spam. HistoryId is the point in the mailbox history the
+// store is in sync with. Partial is set while a full sync has not completed.
+type CadMessageStore struct {
+	HistoryId uint64                     `json:"historyId,omitempty"`
+	SyncedAt  time.Time                  `json:"syncedAt,omitempty"`
+	Partial   bool                       `json:"partial,omitempty"`
+	Messages  map[string]*CadMessageMeta `json:"messages"`
+}
+
+// SyncMessageStore brings the local message store up to date. The first sync, or a
+// forced one, lists and fetches every message, an interrupted first sync resumes where
+// it stopped. Later syncs replay the mailbox history since the stored history id,
+// falling back to a full sync once Gmail has expired it.
+func SyncMessageStore(full bool) (*CadMessageStore, error) {
+	srv, err := GetService()
+	if err != nil {
+		log.Printf("Unable to retrieve Gmail client: %v", err)
+		return nil, err
+	}
+
+	store, err := ReadLocalMessageStore()
+	if err != nil {
+		return nil, err
+	}
+
+	if !full && store.HistoryId != 0 && !store.Partial {
+		err = store.syncHistory(srv)
+		if err == errHistoryExpired {
+			fmt.Println("Message history has expired, running a full sync")
+			full = true
+		} else if err != nil {
+			return nil, err
+		}
+	} else {
+		full = true
+	}
+
+	if full {
+		if !store.Partial {
+			store = &CadMessageStore{}
+		}
+		if err := store.fullSync(srv); err != nil {
+			return nil, err
+		}
+	}
+
+	store.SyncedAt = time.Now().UTC()
+	if err := SaveLocalMessageStore(store); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// fullSync fetches the messages missing from the store and drops the ones no longer
+// listed. The store is saved as it goes, a partial store keeps the history id read
+// when the sync started.
+func (store *CadMessageStore) fullSync(srv *gmail.Service) error {
+	user := "me"
+
+	if !store.Partial {
+		// The history id is read first so changes made during the sync are replayed next time
+		profile, err := srv.Users.GetProfile(user).Do()
+		if err != nil {
+			log.Printf("Unable to retrieve profile: %v", err)
+			return err
+		}
+		store.HistoryId = profile.HistoryId
+		store.Messages = map[string]*CadMessageMeta{}
+		store.Partial = true
+	} else {
+		fmt.Printf("Resuming the message store sync, %d messages already stored\n", len(store.Messages))
+	}
+
+	ids, err := GetMessagesIDsByLabelIDs([]*CadLabel{}, nil)
+	if err != nil {
+		return err
+	}
+
+	listed := map[string]bool{}
+	fetched := 0
+	for i, id := range ids {
+		listed[id] = true
+		if _, ok := store.Messages[id]; ok {
+			continue
+		}
+		if fetched%500 == 0 {
+			fmt.Printf("Fetching message metadata %d/%d\n", i, len(ids))
+		}
+		meta, err := getMessageMeta(srv, id)
+		if err != nil {
+			return err
+		}
+		if meta != nil {
+			store.Messages[id] = meta
+		}
+
+		fetched++
+		if fetched%messageStoreSaveEvery == 0 {
+			if err := SaveLocalMessageStore(store); err != nil {
+				return err
+			}
+		}
+	}
+	for id := range store.Messages {
+		if !listed[id] {
+			delete(store.Messages, id)
+		}
+	}
+	store.Partial = false
+	fmt.Printf("Stored %d messages\n", len(store.Messages))
+
+	return nil
+}
+
+func (store *CadMessageStore) syncHistory(srv *gmail.Service) error {
+	user := "me"
+	changed := map[string]bool{}
+	historyId := store.HistoryId
+
+	moreResults := true
+	pageToken := ""
+	for moreResults {
+		r, err := srv.Users.History.List(user).
+			StartHistoryId(store.HistoryId).
+			MaxResults(500).
+			PageToken(pageToken).
+			Do()
+		if err != nil {
+			if apiErr, ok := err.(*googleapi.Error); ok && apiErr.Code == http.StatusNotFound {
+				return errHistoryExpired
+			}
+			log.Printf("Unable to retrieve message history: %v", err)
+			return err
+		}
+
+		for _, history := range r.History {
+			for _, added := range history.MessagesAdded {
+				changed[added.Message.Id] = true
+			}
+			for _, labelAdded := range history.LabelsAdded {
+				changed[labelAdded.Message.Id] = true
+			}
+			for _, labelRemoved := range history.LabelsRemoved {
+				changed[labelRemoved.Message.Id] = true
+			}
+			for _, deleted := range history.MessagesDeleted {
+				delete(store.Messages, deleted.Message.Id)
+				delete(changed, deleted.Message.Id)
+			}
+		}
+		historyId = r.HistoryId
+
+		if r.NextPageToken != "" {
+			pageToken = r.NextPageToken
+		} else {
+			moreResults = false
+		}
+	}
+
+	for id := range changed {
+		meta, err := getMessageMeta(srv, id)
+		if err != nil {
+			return err
+		}
+		// As in a full sync, messages moved to the trash or spam are not kept
+		if meta == nil || meta.HasLabel("TRASH") || meta.HasLabel("SPAM") {
+			delete(store.Messages, id)
+		} else {
+			store.Messages[id] = meta
+		}
+	}
+	fmt.Printf("Updated %d messages from the message history\n", len(changed))
+
+	store.HistoryId = historyId
+	return nil
+}
+
+// getMessageMeta returns nil when the message has been deleted in the meantime
+func getMessageMeta(srv *gmail.Service, id string) (*CadMessageMeta, error) {
+	user := "me"
+	message, err := srv.Users.Messages.Get(user, id).
+		Format("metadata").
+		MetadataHeaders(messageStoreHeaders...).
+		Do()
+	if err != nil {
+		if apiErr, ok := err.(*googleapi.Error); ok && apiErr.Code == http.StatusNotFound {
+			return nil, nil
+		}
+		log.Printf("Unable to retrieve message: %s %v", id, err)
+		return nil, err
+	}
+	return MarshalCadMessageMeta(message), nil
+}
+
+func MarshalCadMessageMeta(message *gmail.Message) *CadMessageMeta {
+	meta := &CadMessageMeta{
+		Id:           message.Id,
+		ThreadId:     message.ThreadId,
+		LabelIds:     message.LabelIds,
+		InternalDate: message.InternalDate,
+		SizeEstimate: message.SizeEstimate,
+		Headers:      map[string]string{},
+	}
+	if message.Payload != nil {
+		for _, header := range message.Payload.Headers {
+			for _, name := range messageStoreHeaders {
+				if strings.EqualFold(header.Name, name) {
+					meta.Headers[name] = header.Value
+				}
+			}
+		}
+	}
+	return meta
+}
+
+// Header returns the value of one of the stored headers
+func (meta *CadMessageMeta) Header(name string) string {
+	for key, value := range meta.Headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
+
+func (meta *CadMessageMeta) HasLabel(labelId string) bool {
+	return contains(meta.LabelIds, labelId)
+}
+
+func (meta *CadMessageMeta) Date() time.Time {
+	return time.Unix(0, meta.InternalDate*int64(time.Millisecond)).UTC()
+}
+
+// Facts returns the headers of the message in the form used by the query matcher.
+// The body and attachments are not stored, so queries on them cannot be matched locally.
+func (meta *CadMessageMeta) Facts() *CadMessageFacts {
+	return &CadMessageFacts{
+		Id:          meta.Id,
+		From:        meta.Header("From"),
+		To:          meta.Header("To"),
+		Cc:          meta.Header("Cc"),
+		DeliveredTo: meta.Header("Delivered-To"),
+		Subject:     meta.Header("Subject"),
+		ListId:      meta.Header("List-Id"),
+		Size:        meta.SizeEstimate,
+		LabelIds:    meta.LabelIds,
+	}
+}
+
+// GmailMessage returns the stored metadata as a Gmail message with headers only
+func (meta *CadMessageMeta) GmailMessage() *gmail.Message {
+	message := &gmail.Message{
+		Id:           meta.Id,
+		ThreadId:     meta.ThreadId,
+		LabelIds:     meta.LabelIds,
+		InternalDate: meta.InternalDate,
+		SizeEstimate: meta.SizeEstimate,
+		Payload:      &gmail.MessagePart{},
+	}
+	for _, name := range messageStoreHeaders {
+		if value := meta.Header(name); value != "" {
+			message.Payload.Headers = append(message.Payload.Headers, &gmail.MessagePartHeader{Name: name, Value: value})
+		}
+	}
+	return message
+}
+
+// Select returns the stored messages for which the predicate holds, newest first
+func (store *CadMessageStore) Select(predicate func(meta *CadMessageMeta) bool) []*CadMessageMeta {
+	selected := []*CadMessageMeta{}
+	for _, meta := range store.Messages {
+		if predicate(meta) {
+			selected = append(selected, meta)
+		}
+	}
+	sort.SliceStable(selected, func(i, j int) bool {
+		if selected[i].InternalDate != selected[j].InternalDate {
+			return selected[i].InternalDate > selected[j].InternalDate
+		}
+		return selected[i].Id < selected[j].Id
+	})
+	return selected
+}
+
+func SaveLocalMessageStore(store *CadMessageStore) error {
+	b, err := json.Marshal(store)
+	if err != nil {
+		log.Printf("Unable to marshal message store to JSON: %v", err)
+		return err
+	}
+
+	err = ioutil.WriteFile(messagestoredatafile, b, 0664)
+	if err != nil {
+		log.Printf("Unable to persist message store: %v", err)
+		return err
+	}
+	return nil
+}
+
+func ReadLocalMessageStore() (*CadMessageStore, error) {
+	store := &CadMessageStore{Messages: map[string]*CadMessageMeta{}}
+	if !fileExists(messagestoredatafile) {
+		return store, nil
+	}
+
+	b, err := ioutil.ReadFile(messagestoredatafile)
+	if err != nil {
+		log.Printf("Unable to read local message store: %v", err)
+		return nil, err
+	}
+	if err := json.Unmarshal(b, store); err != nil {
+		log.Printf("Unable to parse local message store: %v", err)
+		return nil, err
+	}
+	if store.Messages == nil {
+		store.Messages = map[string]*CadMessageMeta{}
+	}
+
+	return store, nil
+}
@@ -6,11 +6,14 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"regexp"
 	"sort"
 	"strings"
 	"time"
+
+	"google.golang.org/api/googleapi"
 )
 
 const UpdateMessagesMigration string = "update-messages"
@@ -22,6 +25,16 @@ const ReplaceFiltersMigration string = "replace-filters"
 const DeleteFilterMigration string = "delete-filter"
 const DeleteFiltersMigration string = "delete-filters"
 const CreateFilterMigration string = "create-filter"
+const RepairFilterMigration string = "repair-filter"
+const ApplyFilterMigration string = "apply-filter"
+const CreateForwardingAddressMigration string = "create-forwarding-address"
+const DeleteForwardingAddressMigration string = "delete-forwarding-address"
+const TrashMessagesMigration string = "trash-messages"
+const UntrashMessagesMigration string = "untrash-messages"
+const DeleteMessagesMigration string = "delete-messages"
+
+// The value the confirm field of a delete-messages migration must hold
+const DeleteMessagesConfirmation string = "permanently delete"
 
 type CadUpdateMessagesMigration struct {
 	QueryLabelIds  *[]string `json:"queryLabelIds"`
@@ -31,11 +44,38 @@ type CadUpdateMessagesMigration struct {
 	AddLabelIds    *[]string `json:"addLabelIds"`
 }
 
+// CadMessagesMigration selects messages the same way as CadUpdateMessagesMigration,
+// by label ids narrowed by the query, and by message ids
+type CadMessagesMigration struct {
+	QueryLabelIds *[]string `json:"queryLabelIds,omitempty"`
+	MessageIds    *[]string `json:"messageIds,omitempty"`
+	QueryString   *string   `json:"query,omitempty"`
+}
+
+// CadDeleteMessagesMigration permanently deletes messages, bypassing the trash. It only
+// runs when Confirm holds DeleteMessagesConfirmation and at most MaxCount messages match.
+type CadDeleteMessagesMigration struct {
+	QueryLabelIds *[]string `json:"queryLabelIds,omitempty"`
+	MessageIds    *[]string `json:"messageIds,omitempty"`
+	QueryString   *string   `json:"query,omitempty"`
+	Confirm       *string   `json:"confirm"`
+	MaxCount      *int      `json:"maxCount"`
+}
+
 type CadCreateFilterMigration struct {
 	Criteria *CadCriteria `json:"criteria,omitempty"`
 	Action   *CadAction   `json:"action,omitempty"`
 }
 
+// CadApplyFilterMigration applies a filter to the existing mail matching it when the
+// migration runs. The filter is either looked up by Id or given by its criteria and action.
+type CadApplyFilterMigration struct {
+	Id       *string           `json:"id,omitempty"`
+	Criteria *CadCriteria      `json:"criteria,omitempty"`
+	Action   *CadAction        `json:"action,omitempty"`
+	Scope    *CadBackfillScope `json:"scope,omitempty"`
+}
+
 type CadReplaceFiltersMigration struct {
 	Ids    *[]string  `json:"ids"`
 	Action *CadAction `json:"action,omitempty"`
@@ -49,6 +89,10 @@ type CadDeleteFiltersMigration struct {
 	Ids *[]string `json:"ids"`
 }
 
+type CadForwardingAddressMigration struct {
+	ForwardingEmail *string `json:"forwardingEmail"`
+}
+
 type CadUpdateLabelMigration struct {
 	Id                    *string        `json:"id"`
 	Name                  *string        `json:"name,omitempty"`
@@ -72,7 +116,16 @@ type CadCreateLabelMigration struct {
 }
 
 type CadDeleteLabelMigration struct {
-	Id *string `json:"id"`
+	Id      *string `json:"id"`
+	Cascade *bool   `json:"cascade,omitempty"`
+}
+
+// CadRepairFilterMigration rewrites a filter that references a missing label,
+// either pointing it at a (re)created label with the given name or dropping the label
+type CadRepairFilterMigration struct {
+	Id      *string `json:"id"`
+	LabelId *string `json:"labelId"`
+	Name    *string `json:"name,omitempty"`
 }
 
 type CadRawMigration struct {
@@ -86,103 +139,51 @@ const migrationsPath string = "migrations"
 
 var indent string = ""
 
+// RunMigrations runs the pending migration files, or the daily migration files followed
+// by the retention policies of the config
 func RunMigrations(daily bool) error {
-	migrationFiles, err := getMigrationFiles(daily)
+	policies := []CadRetentionPolicy{}
+	if daily {
+		config, err := ReadConfig()
+		if err != nil {
+			return err
+		}
+		policies = config.Retention
+	}
+
+	var migrationFiles []string
+	var err error
+	if len(policies) > 0 {
+		migrationFiles, err = listMigrationFiles(daily)
+	} else {
+		migrationFiles, err = getMigrationFiles(daily)
+	}
 	if err != nil {
 		log.Printf("Unable to fetch migration files: %v", err)
 		return err
 	}
 
-	for _, migrationFile := range migrationFiles {
-		var migrations []CadRawMigration
+	usages, err := PredictLimits(migrationFiles)
+	if err != nil {
+		log.Printf("Unable to predict limits: %v", err)
+		return err
+	}
+	for _, usage := range usages {
+		if usage.Exceeded() {
+			fmt.Printf("Warning: the migrations would take %s to %d, over the Gmail limit of %d\n", usage.Name, usage.Predicted, usage.Limit)
+		}
+	}
 
+	for _, migrationFile := range migrationFiles {
 		fmt.Printf("Processing migration %s\n", migrationFile)
-		b, err := ioutil.ReadFile(migrationFile)
+		migrations, err := ReadMigrationFile(migrationFile)
 		if err != nil {
-			log.Printf("Unable to read the migration file: %v", err)
-			return err
-		}
-		if err := json.Unmarshal(b, &migrations); err != nil {
 			return err
 		}
 
 		for _, migration := range migrations {
-			switch *migration.Operation {
-			case UpdateMessagesMigration:
-				messageMigration := CadUpdateMessagesMigration{}
-				b, _ := migration.RawDetails.MarshalJSON()
-				json.Unmarshal(b, &messageMigration)
-				err := updateMessages(messageMigration)
-				if err != nil {
-					return err
-				}
-			case CreateFilterMigration:
-				filterMigration := CadCreateFilterMigration{}
-				b, _ := migration.RawDetails.MarshalJSON()
-				json.Unmarshal(b, &filterMigration)
-				err := createFilter(filterMigration)
-				if err != nil {
-					return err
-				}
-			case DeleteFilterMigration:
-				filterMigration := CadDeleteFilterMigration{}
-				b, _ := migration.RawDetails.MarshalJSON()
-				json.Unmarshal(b, &filterMigration)
-				err := deleteFilter(filterMigration)
-				if err != nil {
-					return err
-				}
-			case DeleteFiltersMigration:
-				filtersMigration := CadDeleteFiltersMigration{}
-				b, _ := migration.RawDetails.MarshalJSON()
-				json.Unmarshal(b, &filtersMigration)
-				err := deleteFilters(filtersMigration)
-				if err != nil {
-					return err
-				}
-			case UpdateLabelMigration:
-				labelMigration := CadUpdateLabelMigration{}
-				b, _ := migration.RawDetails.MarshalJSON()
-				json.Unmarshal(b, &labelMigration)
-				err := updateLabel(labelMigration)
-				if err != nil {
-					return err
-				}
-			case UpdateLabelsMigration:
-				// labelMigration := CadUpdateLabelMigration{}
-				// b, _ := migration.RawDetails.MarshalJSON()
-				// json.Unmarshal(b, &labelMigration)
-				// err := updateLabel(labelMigration)
-				// if err != nil {
-				// 	return err
-				// }
-				return errors.New("not implemented operation " + *migration.Operation)
-			case CreateLabelMigration:
-				labelMigration := CadCreateLabelMigration{}
-				b, _ := migration.RawDetails.MarshalJSON()
-				json.Unmarshal(b, &labelMigration)
-				err := createLabel(labelMigration)
-				if err != nil {
-					return err
-				}
-			case DeleteLabelMigration:
-				labelMigration := CadDeleteLabelMigration{}
-				b, _ := migration.RawDetails.MarshalJSON()
-				json.Unmarshal(b, &labelMigration)
-				err := deleteLabel(labelMigration)
-				if err != nil {
-					return err
-				}
-			case ReplaceFiltersMigration:
-				filterMigration := CadReplaceFiltersMigration{}
-				b, _ := migration.RawDetails.MarshalJSON()
-				json.Unmarshal(b, &filterMigration)
-				err := replaceFilters(filterMigration)
-				if err != nil {
-					return err
-				}
-			default:
-				return errors.New("unknown operation " + *migration.Operation)
+			if err := runMigration(migration); err != nil {
+				return err
 			}
 		}
 
@@ -199,6 +200,147 @@ func RunMigrations(daily bool) error {
 		}
 	}
 
+	if len(policies) > 0 {
+		return RunRetentionPolicies(policies)
+	}
+
+	return nil
+}
+
+func runMigration(migration CadRawMigration) error {
+	switch *migration.Operation {
+	case UpdateMessagesMigration:
+		messageMigration := CadUpdateMessagesMigration{}
+		b, _ := migration.RawDetails.MarshalJSON()
+		json.Unmarshal(b, &messageMigration)
+		err := updateMessages(messageMigration)
+		if err != nil {
+			return err
+		}
+	case CreateFilterMigration:
+		filterMigration := CadCreateFilterMigration{}
+		b, _ := migration.RawDetails.MarshalJSON()
+		json.Unmarshal(b, &filterMigration)
+		err := createFilter(filterMigration)
+		if err != nil {
+			return err
+		}
+	case DeleteFilterMigration:
+		filterMigration := CadDeleteFilterMigration{}
+		b, _ := migration.RawDetails.MarshalJSON()
+		json.Unmarshal(b, &filterMigration)
+		err := deleteFilter(filterMigration)
+		if err != nil {
+			return err
+		}
+	case DeleteFiltersMigration:
+		filtersMigration := CadDeleteFiltersMigration{}
+		b, _ := migration.RawDetails.MarshalJSON()
+		json.Unmarshal(b, &filtersMigration)
+		err := deleteFilters(filtersMigration)
+		if err != nil {
+			return err
+		}
+	case UpdateLabelMigration:
+		labelMigration := CadUpdateLabelMigration{}
+		b, _ := migration.RawDetails.MarshalJSON()
+		json.Unmarshal(b, &labelMigration)
+		err := updateLabel(labelMigration)
+		if err != nil {
+			return err
+		}
+	case UpdateLabelsMigration:
+		// labelMigration := CadUpdateLabelMigration{}
+		// b, _ := migration.RawDetails.MarshalJSON()
+		// json.Unmarshal(b, &labelMigration)
+		// err := updateLabel(labelMigration)
+		// if err != nil {
+		// 	return err
+		// }
+		return errors.New("not implemented operation " + *migration.Operation)
+	case CreateLabelMigration:
+		labelMigration := CadCreateLabelMigration{}
+		b, _ := migration.RawDetails.MarshalJSON()
+		json.Unmarshal(b, &labelMigration)
+		err := createLabel(labelMigration)
+		if err != nil {
+			return err
+		}
+	case DeleteLabelMigration:
+		labelMigration := CadDeleteLabelMigration{}
+		b, _ := migration.RawDetails.MarshalJSON()
+		json.Unmarshal(b, &labelMigration)
+		err := deleteLabel(labelMigration)
+		if err != nil {
+			return err
+		}
+	case ApplyFilterMigration:
+		filterMigration := CadApplyFilterMigration{}
+		b, _ := migration.RawDetails.MarshalJSON()
+		json.Unmarshal(b, &filterMigration)
+		err := applyFilter(filterMigration)
+		if err != nil {
+			return err
+		}
+	case RepairFilterMigration:
+		filterMigration := CadRepairFilterMigration{}
+		b, _ := migration.RawDetails.MarshalJSON()
+		json.Unmarshal(b, &filterMigration)
+		err := repairFilter(filterMigration)
+		if err != nil {
+			return err
+		}
+	case CreateForwardingAddressMigration:
+		forwardingMigration := CadForwardingAddressMigration{}
+		b, _ := migration.RawDetails.MarshalJSON()
+		json.Unmarshal(b, &forwardingMigration)
+		err := createForwardingAddress(forwardingMigration)
+		if err != nil {
+			return err
+		}
+	case DeleteForwardingAddressMigration:
+		forwardingMigration := CadForwardingAddressMigration{}
+		b, _ := migration.RawDetails.MarshalJSON()
+		json.Unmarshal(b, &forwardingMigration)
+		err := deleteForwardingAddress(forwardingMigration)
+		if err != nil {
+			return err
+		}
+	case TrashMessagesMigration:
+		messagesMigration := CadMessagesMigration{}
+		b, _ := migration.RawDetails.MarshalJSON()
+		json.Unmarshal(b, &messagesMigration)
+		err := trashMessages(messagesMigration)
+		if err != nil {
+			return err
+		}
+	case UntrashMessagesMigration:
+		messagesMigration := CadMessagesMigration{}
+		b, _ := migration.RawDetails.MarshalJSON()
+		json.Unmarshal(b, &messagesMigration)
+		err := untrashMessages(messagesMigration)
+		if err != nil {
+			return err
+		}
+	case DeleteMessagesMigration:
+		messagesMigration := CadDeleteMessagesMigration{}
+		b, _ := migration.RawDetails.MarshalJSON()
+		json.Unmarshal(b, &messagesMigration)
+		err := deleteMessages(messagesMigration)
+		if err != nil {
+			return err
+		}
+	case ReplaceFiltersMigration:
+		filterMigration := CadReplaceFiltersMigration{}
+		b, _ := migration.RawDetails.MarshalJSON()
+		json.Unmarshal(b, &filterMigration)
+		err := replaceFilters(filterMigration)
+		if err != nil {
+			return err
+		}
+	default:
+		return errors.New("unknown operation " + *migration.Operation)
+	}
 	return nil
 }
 
@@ -229,6 +371,19 @@ func (m *CadRawMigration) MarshalJSON() ([]byte, error) {
 }
 
 func getMigrationFiles(daily bool) ([]string, error) {
+	migrationFiles, err := listMigrationFiles(daily)
+	if err != nil {
+		return nil, err
+	}
+	if len(migrationFiles) == 0 {
+		log.Printf("No files to migrate")
+		return nil, errors.New("no migrations files")
+	}
+
+	return migrationFiles, nil
+}
+
+func listMigrationFiles(daily bool) ([]string, error) {
 	files, err := os.ReadDir(migrationsPath)
 	if err != nil {
 		log.Printf("Unable to read the migrations directory: %v", err)
@@ -245,10 +400,6 @@ func getMigrationFiles(daily bool) ([]string, error) {
 			migrationFiles = append(migrationFiles, strings.Join([]string{migrationsPath, file.Name()}, "/"))
 		}
 	}
-	if len(migrationFiles) == 0 {
-		log.Printf("No files to migrate")
-		return nil, errors.New("no migrations files")
-	}
 	sort.SliceStable(migrationFiles, func(i, j int) bool {
 		return migrationFiles[i] < migrationFiles[j]
 	})
@@ -256,6 +407,37 @@ func getMigrationFiles(daily bool) ([]string, error) {
 	return migrationFiles, nil
 }
 
+// PendingMigrationFiles returns the migration files that have not been run yet
+// followed by the daily migration files
+func PendingMigrationFiles() ([]string, error) {
+	migrationFiles, err := listMigrationFiles(false)
+	if err != nil {
+		return nil, err
+	}
+	dailyFiles, err := listMigrationFiles(true)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(migrationFiles, dailyFiles...), nil
+}
+
+func ReadMigrationFile(migrationFile string) ([]CadRawMigration, error) {
+	var migrations []CadRawMigration
+
+	b, err := ioutil.ReadFile(migrationFile)
+	if err != nil {
+		log.Printf("Unable to read the migration file: %v", err)
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &migrations); err != nil {
+		log.Printf("Unable to parse the migration file %s: %v", migrationFile, err)
+		return nil, err
+	}
+
+	return migrations, nil
+}
+
 func CreateMigrationFile(migrations *[]CadRawMigration) error {
 	data, err := json.MarshalIndent(migrations, "", " ")
 	if err != nil {
@@ -302,7 +484,9 @@ func updateMessages(migration CadUpdateMessagesMigration) error {
 		}
 
 	}
-	messageIds = append(messageIds, *migration.MessageIds...)
+	if migration.MessageIds != nil {
+		messageIds = append(messageIds, *migration.MessageIds...)
+	}
 
 	err = BulkUpdateMessageLabels(
 		messageIds,
@@ -317,7 +501,142 @@ func updateMessages(migration CadUpdateMessagesMigration) error {
 	return nil
 }
 
+// selectMessages resolves the message selection of the trash, untrash and delete
+// migrations: the messages with the label ids narrowed by the query, or matching the
+// query alone, plus the listed message ids. A migration without any of them is refused
+// rather than selecting the whole mailbox. update-messages keeps its own selection,
+// where a query only narrows the label ids.
+func selectMessages(queryLabelIds *[]string, messageIds *[]string, query *string) ([]string, error) {
+	labels := []*CadLabel{}
+	if queryLabelIds != nil {
+		for _, labelId := range *queryLabelIds {
+			labels = append(labels, &CadLabel{Id: labelId})
+		}
+	}
+	if query != nil && *query == "" {
+		query = nil
+	}
+
+	selected := []string{}
+	if len(labels) > 0 || query != nil {
+		ids, err := GetMessagesIDsByLabelIDs(labels, query)
+		if err != nil {
+			log.Printf("Unable to retrieve message Ids: %v", err)
+			return nil, err
+		}
+		selected = append(selected, ids...)
+	}
+	if messageIds != nil {
+		selected = append(selected, *messageIds...)
+	}
+	if len(labels) == 0 && query == nil && (messageIds == nil || len(*messageIds) == 0) {
+		return nil, errors.New("no queryLabelIds, query or messageIds to select messages")
+	}
+
+	seen := map[string]bool{}
+	unique := []string{}
+	for _, id := range selected {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique, nil
+}
+
+func trashMessages(migration CadMessagesMigration) error {
+	messageIds, err := selectMessages(migration.QueryLabelIds, migration.MessageIds, migration.QueryString)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%sTrashing %d messages...\n", indent, len(messageIds))
+	return TrashMessages(messageIds)
+}
+
+func untrashMessages(migration CadMessagesMigration) error {
+	messageIds, err := selectMessages(migration.QueryLabelIds, migration.MessageIds, migration.QueryString)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%sRestoring %d messages from the trash...\n", indent, len(messageIds))
+	return UntrashMessages(messageIds)
+}
+
+func deleteMessages(migration CadDeleteMessagesMigration) error {
+	if migration.Confirm == nil || *migration.Confirm != DeleteMessagesConfirmation {
+		return fmt.Errorf("%s requires \"confirm\": \"%s\"", DeleteMessagesMigration, DeleteMessagesConfirmation)
+	}
+	if migration.MaxCount == nil || *migration.MaxCount <= 0 {
+		return fmt.Errorf("%s requires a positive maxCount", DeleteMessagesMigration)
+	}
+
+	messageIds, err := selectMessages(migration.QueryLabelIds, migration.MessageIds, migration.QueryString)
+	if err != nil {
+		return err
+	}
+	if len(messageIds) > *migration.MaxCount {
+		return fmt.Errorf("%s selected %d messages, more than the maxCount of %d", DeleteMessagesMigration, len(messageIds), *migration.MaxCount)
+	}
+
+	fmt.Printf("%sPermanently deleting %d messages...\n", indent, len(messageIds))
+	return DeleteMessages(messageIds)
+}
+
+func applyFilter(migration CadApplyFilterMigration) error {
+	cadFilter := &CadFilter{Criteria: migration.Criteria, Action: migration.Action}
+	if migration.Id != nil {
+		fmt.Printf("%sApplying filter... %s\n", indent, *migration.Id)
+
+		// The filter may have been deleted or replaced since the migration was written,
+		// eg by an earlier migration of the same run
+		filter, err := GetFilter(&CadFilter{Id: *migration.Id})
+		if apiErr, ok := err.(*googleapi.Error); ok && apiErr.Code == http.StatusNotFound {
+			fmt.Printf("%s\tWarning: filter %s no longer exists, skipping\n", indent, *migration.Id)
+			return nil
+		}
+		if err != nil {
+			log.Printf("Unable to retrieve filter %s", *migration.Id)
+			return err
+		}
+		if cadFilter.Criteria == nil {
+			cadFilter.Criteria = filter.Criteria
+		}
+		if cadFilter.Action == nil {
+			cadFilter.Action = filter.Action
+		}
+	} else {
+		fmt.Printf("%sApplying filter...\n", indent)
+	}
+
+	if cadFilter.Criteria == nil || cadFilter.Action == nil {
+		log.Printf("Filter criteria and action cannot be nil")
+		return errors.New("apply Filter called without a filter id or criteria and action")
+	}
+
+	scope := CadBackfillScope{}
+	if migration.Scope != nil {
+		scope = *migration.Scope
+	}
+
+	messageIds, err := BackfillMessageIds(*cadFilter, scope)
+	if err != nil {
+		log.Printf("Unable to retrieve message Ids: %v", err)
+		return err
+	}
+	fmt.Printf("%s\tFound %d messages\n", indent, len(messageIds))
+
+	return ApplyFilterAction(messageIds, *cadFilter.Action, false)
+}
+
 func createFilter(migration CadCreateFilterMigration) error {
+	_, err := createFilters(migration)
+	return err
+}
+
+// createFilters creates the filters of a create-filter migration and returns them
+func createFilters(migration CadCreateFilterMigration) ([]*CadFilter, error) {
 	fmt.Printf("%sCreating filter...%s %s %s %s\n",
 		indent,
 		migration.Criteria.From,
@@ -325,10 +644,17 @@ func createFilter(migration CadCreateFilterMigration) error {
 		migration.Criteria.Subject,
 		migration.Criteria.Query)
 
+	if migration.Action.Forward != "" {
+		if err := VerifyForwardingAddress(migration.Action.Forward); err != nil {
+			log.Printf("Unable to create filter forwarding to %s: %v", migration.Action.Forward, err)
+			return nil, err
+		}
+	}
+
 	labels, err := GetLabels()
 	if err != nil {
 		log.Printf("Unable to retrieve labels\n")
-		return err
+		return nil, err
 	}
 
 	labelIdToType := map[string]string{}
@@ -343,15 +669,48 @@ func createFilter(migration CadCreateFilterMigration) error {
 	for _, labelId := range migration.Action.RemoveLabelIds {
 		if labelIdToType[labelId] == "user" {
 			log.Printf("Unable to create filter with user label removeLabelId %s \n", labelId)
-			return fmt.Errorf("unable to create filter with user label removeLabelId %s", labelId)
+			return nil, fmt.Errorf("unable to create filter with user label removeLabelId %s", labelId)
+		}
+	}
+
+	newFilters := splitFilter(migration.Criteria, *migration.Action, labelIdToType)
+	for _, filter := range newFilters {
+		if len(filter.Action.AddLabelIds) == 0 && len(filter.Action.RemoveLabelIds) == 0 && filter.Action.Forward == "" {
+			log.Printf("Unable to create filter without an action\n")
+			return nil, errors.New("unable to create filter without an action")
+		}
+	}
+
+	createdFilters := []*CadFilter{}
+	indent = fmt.Sprintf("%s\t", indent)
+	for _, filter := range newFilters {
+		fmt.Printf("%sCreating subfilter...\n", indent)
+		createdFilter, err := CreateFilter(filter)
+		if err != nil {
+			log.Printf("Unable to create new filter")
+			indent = indent[:len(indent)-1]
+			return createdFilters, err
 		}
+		if createdFilter == nil {
+			// The same filter already exists
+			createdFilter = filter
+		}
+		createdFilters = append(createdFilters, createdFilter)
 	}
+	indent = indent[:len(indent)-1]
 
+	return createdFilters, nil
+}
+
+// splitFilter splits a filter into one filter per user label, since Gmail only
+// allows a single user label per filter. The other labels and the forward go on the
+// first filter.
+func splitFilter(criteria *CadCriteria, migrationAction CadAction, labelIdToType map[string]string) []*CadFilter {
 	newFilters := []*CadFilter{}
-	action := &CadAction{RemoveLabelIds: migration.Action.RemoveLabelIds}
-	currentNewCadFilter := &CadFilter{Action: action, Criteria: migration.Criteria}
+	action := &CadAction{RemoveLabelIds: migrationAction.RemoveLabelIds, Forward: migrationAction.Forward}
+	currentNewCadFilter := &CadFilter{Action: action, Criteria: criteria}
 	userLabelCount := 0
-	for _, labelId := range migration.Action.AddLabelIds {
+	for _, labelId := range migrationAction.AddLabelIds {
 		if labelIdToType[labelId] == "user" && userLabelCount >= 1 {
 			newFilters = append(newFilters, currentNewCadFilter)
 			action = &CadAction{AddLabelIds: []string{labelId}}
@@ -362,22 +721,11 @@ func createFilter(migration CadCreateFilterMigration) error {
 				userLabelCount += 1
 			}
 		}
-		currentNewCadFilter = &CadFilter{Action: action, Criteria: migration.Criteria}
+		currentNewCadFilter = &CadFilter{Action: action, Criteria: criteria}
 	}
 	newFilters = append(newFilters, currentNewCadFilter)
 
-	indent = fmt.Sprintf("%s\t", indent)
-	for _, filter := range newFilters {
-		fmt.Printf("%sCreating subfilter...\n", indent)
-		_, err := CreateFilter(filter)
-		if err != nil {
-			log.Printf("Unable to create new filter")
-			return err
-		}
-	}
-	indent = indent[:len(indent)-1]
-
-	return nil
+	return newFilters
 }
 
 func deleteFilter(migration CadDeleteFilterMigration) error {
@@ -410,6 +758,42 @@ func deleteFilters(bulkMigration CadDeleteFiltersMigration) error {
 	return nil
 }
 
+func createForwardingAddress(migration CadForwardingAddressMigration) error {
+	if migration.ForwardingEmail == nil {
+		log.Printf("Forwarding email cannot be nil")
+		return errors.New("create Forwarding Address called with missing email")
+	}
+
+	fmt.Println("Creating forwarding address...", *migration.ForwardingEmail)
+	address, err := CreateForwardingAddress(*migration.ForwardingEmail)
+	if err != nil {
+		log.Printf("Unable to create forwarding address")
+		return err
+	}
+
+	if address.VerificationStatus != forwardingAccepted {
+		fmt.Printf("\tForwarding address is %s, accept the verification mail sent to %s before forwarding to it\n", address.VerificationStatus, address.ForwardingEmail)
+	}
+
+	return nil
+}
+
+func deleteForwardingAddress(migration CadForwardingAddressMigration) error {
+	if migration.ForwardingEmail == nil {
+		log.Printf("Forwarding email cannot be nil")
+		return errors.New("delete Forwarding Address called with missing email")
+	}
+
+	fmt.Println("Deleting forwarding address...", *migration.ForwardingEmail)
+	err := DeleteForwardingAddress(*migration.ForwardingEmail)
+	if err != nil {
+		log.Printf("Unable to delete forwarding address %s", *migration.ForwardingEmail)
+		return err
+	}
+
+	return nil
+}
+
 func createLabel(migration CadCreateLabelMigration) error {
 	fmt.Println("Creating label...", *migration.Name)
 
@@ -444,8 +828,38 @@ func deleteLabel(migration CadDeleteLabelMigration) error {
 		return errors.New("delete Label called with missing label id")
 	}
 
+	filters, err := GetFilters()
+	if err != nil {
+		log.Printf("Unable to retrieve filters\n")
+		return err
+	}
+
+	referencing := []string{}
+	for _, filter := range filters {
+		if contains(filter.Action.AddLabelIds, *migration.Id) || contains(filter.Action.RemoveLabelIds, *migration.Id) {
+			referencing = append(referencing, filter.Id)
+		}
+	}
+
+	if len(referencing) > 0 {
+		if migration.Cascade == nil || !*migration.Cascade {
+			log.Printf("Label %s is still referenced by filters %s", *migration.Id, strings.Join(referencing, ", "))
+			return fmt.Errorf("label %s is still referenced by %d filters, set cascade to remove it from them", *migration.Id, len(referencing))
+		}
+
+		indent = fmt.Sprintf("%s\t", indent)
+		for _, id := range referencing {
+			filterId := id
+			err := repairFilter(CadRepairFilterMigration{Id: &filterId, LabelId: migration.Id})
+			if err != nil {
+				return err
+			}
+		}
+		indent = indent[:len(indent)-1]
+	}
+
 	oldCadLabel := &CadLabel{Id: *migration.Id}
-	err := DeleteUserLabel(oldCadLabel)
+	err = DeleteUserLabel(oldCadLabel)
 	if err != nil {
 		log.Printf("Unable to delete label %v", *migration.Id)
 		return err
@@ -454,6 +868,81 @@ func deleteLabel(migration CadDeleteLabelMigration) error {
 	return nil
 }
 
+func repairFilter(migration CadRepairFilterMigration) error {
+	if migration.Id == nil || migration.LabelId == nil {
+		log.Printf("Filter Id and label Id cannot be nil")
+		return errors.New("repair Filter called with missing filter or label id")
+	}
+
+	fmt.Printf("%sRepairing filter... %s\n", indent, *migration.Id)
+
+	cadFilter, err := GetFilter(&CadFilter{Id: *migration.Id})
+	if err != nil {
+		log.Printf("Unable to retrieve filter %s", *migration.Id)
+		return err
+	}
+
+	replacementId := ""
+	if migration.Name != nil {
+		label, err := FindOrCreateUserLabel(*migration.Name)
+		if err != nil {
+			log.Printf("Unable to recreate label %s", *migration.Name)
+			return err
+		}
+		replacementId = label.Id
+	}
+
+	action := &CadAction{Forward: cadFilter.Action.Forward}
+	for _, labelId := range cadFilter.Action.AddLabelIds {
+		if labelId != *migration.LabelId {
+			action.AddLabelIds = append(action.AddLabelIds, labelId)
+		} else if replacementId != "" {
+			action.AddLabelIds = append(action.AddLabelIds, replacementId)
+		}
+	}
+	for _, labelId := range cadFilter.Action.RemoveLabelIds {
+		if labelId != *migration.LabelId {
+			action.RemoveLabelIds = append(action.RemoveLabelIds, labelId)
+		}
+	}
+
+	// Check the forward before deleting the filter, a failed recreation would lose it
+	if action.Forward != "" {
+		if err := VerifyForwardingAddress(action.Forward); err != nil {
+			log.Printf("Unable to repair filter forwarding to %s: %v", action.Forward, err)
+			return err
+		}
+	}
+
+	err = deleteFilter(CadDeleteFilterMigration{Id: migration.Id})
+	if err != nil {
+		return err
+	}
+
+	if len(action.AddLabelIds) == 0 && len(action.RemoveLabelIds) == 0 && action.Forward == "" {
+		fmt.Printf("%sFilter has no remaining actions, not recreating it\n", indent)
+		return nil
+	}
+
+	createdFilters, err := createFilters(CadCreateFilterMigration{Criteria: cadFilter.Criteria, Action: action})
+	if err != nil {
+		return err
+	}
+	if action.Forward != "" {
+		forwards := false
+		for _, filter := range createdFilters {
+			if filter.Action.Forward == action.Forward {
+				forwards = true
+			}
+		}
+		if !forwards {
+			return fmt.Errorf("repaired filter %s no longer forwards to %s", *migration.Id, action.Forward)
+		}
+	}
+
+	return nil
+}
+
 func updateLabel(migration CadUpdateLabelMigration) error {
 	fmt.Println("Update label...", *migration.Id)
 
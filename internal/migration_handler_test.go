@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitFilter(t *testing.T) {
+	labelIdToType := map[string]string{"Label_1": "user", "Label_2": "user", "IMPORTANT": "system"}
+	criteria := &CadCriteria{From: "news@example.com"}
+
+	tests := []struct {
+		name   string
+		action CadAction
+		want   []CadAction
+	}{
+		{
+			name:   "forward only",
+			action: CadAction{Forward: "me@example.com"},
+			want:   []CadAction{{Forward: "me@example.com"}},
+		},
+		{
+			name:   "one user label",
+			action: CadAction{AddLabelIds: []string{"Label_1"}, RemoveLabelIds: []string{"INBOX"}},
+			want:   []CadAction{{AddLabelIds: []string{"Label_1"}, RemoveLabelIds: []string{"INBOX"}}},
+		},
+		{
+			name:   "several user labels keep the forward on the first filter",
+			action: CadAction{AddLabelIds: []string{"IMPORTANT", "Label_1", "Label_2"}, RemoveLabelIds: []string{"INBOX"}, Forward: "me@example.com"},
+			want: []CadAction{
+				{AddLabelIds: []string{"IMPORTANT", "Label_1"}, RemoveLabelIds: []string{"INBOX"}, Forward: "me@example.com"},
+				{AddLabelIds: []string{"Label_2"}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []CadAction{}
+			for _, filter := range splitFilter(criteria, tt.action, labelIdToType) {
+				if filter.Criteria != criteria {
+					t.Errorf("split filter has criteria %+v, want %+v", filter.Criteria, criteria)
+				}
+				got = append(got, *filter.Action)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitFilter() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,265 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/encoding/htmlindex"
+	"google.golang.org/api/gmail/v1"
+)
+
+// CadMessageContent is the decoded content of a message. Text and HTML hold every
+// text/plain and text/html part, converted to UTF-8.
+type CadMessageContent struct {
+	Text        []string        `json:"text,omitempty"`
+	HTML        []string        `json:"html,omitempty"`
+	Attachments []CadAttachment `json:"attachments,omitempty"`
+}
+
+// CadAttachment describes an attachment. Data is only set when the attachment
+// bodies were requested.
+type CadAttachment struct {
+	PartId       string `json:"partId,omitempty"`
+	Filename     string `json:"filename"`
+	MimeType     string `json:"mimeType,omitempty"`
+	AttachmentId string `json:"attachmentId,omitempty"`
+	Size         int64  `json:"size,omitempty"`
+	Data         []byte `json:"-"`
+}
+
+// WalkMessageParts visits a message part and all of its nested parts, depth first
+func WalkMessageParts(part *gmail.MessagePart, visit func(part *gmail.MessagePart) error) error {
+	if part == nil {
+		return nil
+	}
+	if err := visit(part); err != nil {
+		return err
+	}
+	for _, child := range part.Parts {
+		if err := WalkMessageParts(child, visit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadMessageContent decodes the text, HTML and attachments of a message fetched in the
+// full format. Bodies Gmail only returns by attachment id are fetched when needed.
+func ReadMessageContent(srv *gmail.Service, message *gmail.Message, fetchAttachments bool) (*CadMessageContent, error) {
+	content := &CadMessageContent{}
+	err := WalkMessageParts(message.Payload, func(part *gmail.MessagePart) error {
+		if strings.HasPrefix(part.MimeType, "multipart/") || part.Body == nil {
+			return nil
+		}
+
+		_, params, _ := mime.ParseMediaType(gmailPartHeader(part, "Content-Type"))
+		disposition := strings.ToLower(gmailPartHeader(part, "Content-Disposition"))
+		isAttachment := part.Filename != "" || strings.HasPrefix(disposition, "attachment")
+
+		if isAttachment {
+			attachment := CadAttachment{
+				PartId:       part.PartId,
+				Filename:     part.Filename,
+				MimeType:     part.MimeType,
+				AttachmentId: part.Body.AttachmentId,
+				Size:         part.Body.Size,
+			}
+			if fetchAttachments {
+				data, err := gmailPartBody(srv, message.Id, part)
+				if err != nil {
+					return err
+				}
+				attachment.Data = data
+			}
+			content.Attachments = append(content.Attachments, attachment)
+			return nil
+		}
+
+		if part.MimeType != "text/plain" && part.MimeType != "text/html" {
+			return nil
+		}
+		data, err := gmailPartBody(srv, message.Id, part)
+		if err != nil {
+			return err
+		}
+		content.addText(part.MimeType, decodeCharset(data, params["charset"]))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return content, nil
+}
+
+// ReadRawMessageContent decodes the text, HTML and attachments of an RFC 2822 message,
+// handling base64 and quoted-printable transfer encodings
+func ReadRawMessageContent(message *mail.Message) (*CadMessageContent, error) {
+	content := &CadMessageContent{}
+	if err := readMimePart(message.Header, message.Body, content); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+type mimeHeader interface {
+	Get(key string) string
+}
+
+func readMimePart(header mimeHeader, r io.Reader, content *CadMessageContent) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(r, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := readMimePart(part.Header, part, content); err != nil {
+				return err
+			}
+		}
+	}
+
+	// multipart.Reader already decodes quoted-printable parts and hides the header
+	switch strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding"))) {
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	case "base64":
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		decoded, err := decodeBase64(string(b))
+		if err != nil {
+			log.Printf("Unable to decode base64 part: %v", err)
+			return err
+		}
+		r = bytes.NewReader(decoded)
+	}
+
+	disposition := header.Get("Content-Disposition")
+	_, dispositionParams, _ := mime.ParseMediaType(disposition)
+	filename := dispositionParams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+	if filename != "" || strings.HasPrefix(strings.ToLower(disposition), "attachment") {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		content.Attachments = append(content.Attachments, CadAttachment{
+			Filename: filename,
+			MimeType: mediaType,
+			Size:     int64(len(data)),
+			Data:     data,
+		})
+		return nil
+	}
+
+	if mediaType == "text/plain" || mediaType == "text/html" {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		content.addText(mediaType, decodeCharset(data, params["charset"]))
+	}
+
+	return nil
+}
+
+// Body returns the text and HTML parts joined together
+func (content *CadMessageContent) Body() string {
+	return strings.Join(append(append([]string{}, content.Text...), content.HTML...), "\n")
+}
+
+func (content *CadMessageContent) addText(mediaType string, text string) {
+	if mediaType == "text/html" {
+		content.HTML = append(content.HTML, text)
+	} else {
+		content.Text = append(content.Text, text)
+	}
+}
+
+// gmailPartBody returns the decoded body of a part, fetching it by attachment id
+// when Gmail did not inline it
+func gmailPartBody(srv *gmail.Service, messageId string, part *gmail.MessagePart) ([]byte, error) {
+	data := part.Body.Data
+	if data == "" && part.Body.AttachmentId != "" {
+		user := "me"
+		body, err := srv.Users.Messages.Attachments.Get(user, messageId, part.Body.AttachmentId).Do()
+		if err != nil {
+			log.Printf("Unable to retrieve attachment: %s %v", part.Body.AttachmentId, err)
+			return nil, err
+		}
+		data = body.Data
+	}
+
+	decoded, err := decodeBase64(data)
+	if err != nil {
+		log.Printf("Unable to decode part %s of message %s: %v", part.PartId, messageId, err)
+		return nil, err
+	}
+	return decoded, nil
+}
+
+func gmailPartHeader(part *gmail.MessagePart, name string) string {
+	for _, header := range part.Headers {
+		if strings.EqualFold(header.Name, name) {
+			return header.Value
+		}
+	}
+	return ""
+}
+
+// decodeBase64 decodes standard or URL base64, with or without padding and line breaks
+func decodeBase64(data string) ([]byte, error) {
+	data = strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, data)
+	data = strings.TrimRight(data, "=")
+
+	if strings.ContainsAny(data, "-_") {
+		return base64.RawURLEncoding.DecodeString(data)
+	}
+	return base64.RawStdEncoding.DecodeString(data)
+}
+
+// decodeCharset converts text in the given charset to UTF-8, leaving it unchanged
+// when the charset is unknown
+func decodeCharset(data []byte, charset string) string {
+	charset = strings.ToLower(strings.TrimSpace(charset))
+	if charset == "" || charset == "utf-8" || charset == "us-ascii" {
+		return string(data)
+	}
+
+	encoding, err := htmlindex.Get(charset)
+	if err != nil {
+		return string(data)
+	}
+	decoded, err := encoding.NewDecoder().Bytes(data)
+	if err != nil {
+		return string(data)
+	}
+	return string(decoded)
+}
@@ -0,0 +1,154 @@
+package internal
+
+import (
+	"net/mail"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadRawMessageContent(t *testing.T) {
+	tests := []struct {
+		name        string
+		message     string
+		text        []string
+		html        []string
+		attachments []string
+	}{
+		{
+			name: "no content type",
+			message: "Subject: a\r\n" +
+				"\r\n" +
+				"plain body",
+			text: []string{"plain body"},
+		},
+		{
+			name: "top level quoted-printable latin-1",
+			message: "Content-Type: text/plain; charset=ISO-8859-1\r\n" +
+				"Content-Transfer-Encoding: quoted-printable\r\n" +
+				"\r\n" +
+				"Caf=E9 cr=E8me, a long line that is =\r\n" +
+				"soft broken",
+			text: []string{"Café crème, a long line that is soft broken"},
+		},
+		{
+			name: "nested multipart",
+			message: "Content-Type: multipart/mixed; boundary=outer\r\n" +
+				"\r\n" +
+				"--outer\r\n" +
+				"Content-Type: multipart/alternative; boundary=inner\r\n" +
+				"\r\n" +
+				"--inner\r\n" +
+				"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+				"Content-Transfer-Encoding: quoted-printable\r\n" +
+				"\r\n" +
+				"d=E9sabonner\r\n" +
+				"--inner\r\n" +
+				"Content-Type: text/html; charset=utf-8\r\n" +
+				"Content-Transfer-Encoding: base64\r\n" +
+				"\r\n" +
+				"PGI+eDwv\r\n" +
+				"Yj4\r\n" +
+				"--inner--\r\n" +
+				"--outer\r\n" +
+				"Content-Type: application/pdf; name=invoice.pdf\r\n" +
+				"Content-Transfer-Encoding: base64\r\n" +
+				"\r\n" +
+				"YWJj\r\n" +
+				"--outer\r\n" +
+				"Content-Type: text/plain\r\n" +
+				"Content-Disposition: attachment; filename=\"notes.txt\"\r\n" +
+				"\r\n" +
+				"not body text\r\n" +
+				"--outer--\r\n",
+			text:        []string{"désabonner"},
+			html:        []string{"<b>x</b>"},
+			attachments: []string{"invoice.pdf application/pdf abc", "notes.txt text/plain not body text"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message, err := mail.ReadMessage(strings.NewReader(tt.message))
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, err := ReadRawMessageContent(message)
+			if err != nil {
+				t.Fatalf("ReadRawMessageContent() error = %v", err)
+			}
+			attachments := []string{}
+			for _, attachment := range content.Attachments {
+				attachments = append(attachments, attachment.Filename+" "+attachment.MimeType+" "+string(attachment.Data))
+			}
+			if len(tt.attachments) == 0 {
+				tt.attachments = []string{}
+			}
+			if !reflect.DeepEqual(content.Text, tt.text) || !reflect.DeepEqual(content.HTML, tt.html) {
+				t.Errorf("ReadRawMessageContent() text %q html %q, want %q %q", content.Text, content.HTML, tt.text, tt.html)
+			}
+			if !reflect.DeepEqual(attachments, tt.attachments) {
+				t.Errorf("ReadRawMessageContent() attachments %q, want %q", attachments, tt.attachments)
+			}
+		})
+	}
+}
+
+func TestDecodeBase64(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    string
+		wantErr bool
+	}{
+		{name: "padded", data: "PGI+eDwvYj4=", want: "<b>x</b>"},
+		{name: "unpadded", data: "PGI+eDwvYj4", want: "<b>x</b>"},
+		{name: "line breaks", data: "PGI+\r\neDwv\nYj4=", want: "<b>x</b>"},
+		{name: "url encoding", data: "PGI-eDwvYj4", want: "<b>x</b>"},
+		{name: "url encoding with slash replaced", data: "Pz8_", want: "???"},
+		{name: "empty", data: "", want: ""},
+		{name: "invalid", data: "!!!!", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeBase64(tt.data)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("decodeBase64(%q) = %q, want an error", tt.data, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeBase64(%q) error = %v", tt.data, err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("decodeBase64(%q) = %q, want %q", tt.data, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeCharset(t *testing.T) {
+	tests := []struct {
+		charset string
+		data    []byte
+		want    string
+	}{
+		{charset: "", data: []byte("café"), want: "café"},
+		{charset: "UTF-8", data: []byte("café"), want: "café"},
+		{charset: "iso-8859-1", data: []byte{'c', 'a', 'f', 0xe9}, want: "café"},
+		{charset: " Latin1 ", data: []byte{'c', 'a', 'f', 0xe9}, want: "café"},
+		{charset: "windows-1252", data: []byte{0x80, '5'}, want: "€5"},
+		{charset: "shift_jis", data: []byte{0x82, 0xa0}, want: "あ"},
+		{charset: "x-unknown", data: []byte("as is"), want: "as is"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.charset, func(t *testing.T) {
+			if got := decodeCharset(tt.data, tt.charset); got != tt.want {
+				t.Errorf("decodeCharset(%q) = %q, want %q", tt.charset, got, tt.want)
+			}
+		})
+	}
+}
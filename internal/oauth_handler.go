@@ -15,7 +15,24 @@ import (
 	"google.golang.org/api/option"
 )
 
+const tokenfile string = "data/token.json"
+
+// The token holding the https://mail.google.com/ scope, which is only requested by
+// the operations that need it, eg permanently deleting messages
+const fullmailtokenfile string = "data/token-full-mail.json"
+
 func GetService() (*gmail.Service, error) {
+	// If modifying these scopes, delete your previously saved token.json.
+	return newService(tokenfile, gmail.GmailModifyScope, gmail.GmailSettingsBasicScope, gmail.GmailSettingsSharingScope)
+}
+
+// GetFullMailService returns a service with unrestricted access to the mailbox. It is
+// authorized separately from GetService so the scope is only granted when needed.
+func GetFullMailService() (*gmail.Service, error) {
+	return newService(fullmailtokenfile, gmail.MailGoogleComScope)
+}
+
+func newService(tokFile string, scopes ...string) (*gmail.Service, error) {
 	ctx := context.Background()
 	b, err := ioutil.ReadFile("data/credentials.json")
 	if err != nil {
@@ -23,13 +40,12 @@ func GetService() (*gmail.Service, error) {
 		return nil, err
 	}
 
-	// If modifying these scopes, delete your previously saved token.json.
-	config, err := google.ConfigFromJSON(b, gmail.GmailModifyScope, gmail.GmailSettingsBasicScope)
+	config, err := google.ConfigFromJSON(b, scopes...)
 	if err != nil {
 		log.Printf("Unable to parse client secret file to config: %v", err)
 		return nil, err
 	}
-	client := GetClient(config)
+	client := getClientWithToken(config, tokFile)
 
 	return gmail.NewService(ctx, option.WithHTTPClient(client))
 }
@@ -39,7 +55,10 @@ func GetClient(config *oauth2.Config) *http.Client {
 	// The file token.json stores the user's access and refresh tokens, and is
 	// created automatically when the authorization flow completes for the first
 	// time.
-	tokFile := "data/token.json"
+	return getClientWithToken(config, tokenfile)
+}
+
+func getClientWithToken(config *oauth2.Config, tokFile string) *http.Client {
 	tok, err := tokenFromFile(tokFile)
 	if err != nil {
 		tok = getTokenFromWeb(config)
@@ -0,0 +1,392 @@
+package internal
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"unicode"
+)
+
+const ShadowedFilterRelationship string = "shadowed"
+const ConflictingFiltersRelationship string = "conflict"
+const MultipleUserLabelsRelationship string = "multiple-labels"
+
+// CadFilterRelationship describes how a filter overlaps with a broader (or equivalent) filter
+type CadFilterRelationship struct {
+	Kind        string           `json:"kind"`
+	Filter      CadFilter        `json:"filter"`
+	Broader     CadFilter        `json:"broader"`
+	Explanation string           `json:"explanation"`
+	Suggestion  *CadRawMigration `json:"suggestion,omitempty"`
+}
+
+// AnalyzeFilterOverlaps finds local filters whose criteria are covered by another
+// filter and reports the ones that are redundant, contradict each other or
+// apply several user labels to the same mail
+func AnalyzeFilterOverlaps() ([]CadFilterRelationship, error) {
+	filters, err := ReadLocalFilters()
+	if err != nil {
+		log.Printf("Unable to read local filters file: %v", err)
+		return nil, err
+	}
+
+	localLabels, err := ReadLocalLabels()
+	if err != nil {
+		log.Printf("Unable to read local labels: %v", err)
+		return nil, err
+	}
+	labelmap := map[string]CadLabel{}
+	for _, label := range localLabels {
+		labelmap[label.Id] = label
+	}
+
+	nodes := make([]*CadQueryNode, len(filters))
+	for i, filter := range filters {
+		if filter.Criteria == nil || filter.Action == nil {
+			continue
+		}
+		node, err := CriteriaNode(*filter.Criteria)
+		if err != nil || (node.Kind == QueryAnd && len(node.Children) == 0) {
+			continue
+		}
+		nodes[i] = node
+	}
+
+	relationships := []CadFilterRelationship{}
+	for i := range filters {
+		for j := i + 1; j < len(filters); j++ {
+			if nodes[i] == nil || nodes[j] == nil {
+				continue
+			}
+
+			narrow, broad := -1, -1
+			if queryCovers(nodes[j], nodes[i]) {
+				narrow, broad = i, j
+			} else if queryCovers(nodes[i], nodes[j]) {
+				narrow, broad = j, i
+			} else {
+				continue
+			}
+
+			relationship := filterRelationship(filters[narrow], filters[broad], labelmap)
+			if relationship != nil {
+				relationships = append(relationships, *relationship)
+			}
+		}
+	}
+
+	return relationships, nil
+}
+
+// CriteriaNode parses the search query equivalent to the criteria into a normalized query tree
+func CriteriaNode(criteria CadCriteria) (*CadQueryNode, error) {
+	node, err := ParseQuery(CriteriaQuery(criteria))
+	if err != nil {
+		return nil, err
+	}
+
+	if node.Kind == QueryAnd && len(node.Children) == 0 {
+		return node, nil
+	}
+	return node.Normalize(), nil
+}
+
+func filterRelationship(narrow CadFilter, broad CadFilter, labelmap map[string]CadLabel) *CadFilterRelationship {
+	sameCriteria := CriteriaKey(*narrow.Criteria) == CriteriaKey(*broad.Criteria)
+	sameAction := ActionKey(*narrow.Action) == ActionKey(*broad.Action)
+	if sameCriteria && sameAction {
+		// Exact duplicates are reported by DuplicateFilters
+		return nil
+	}
+
+	labelName := func(labelId string) string {
+		if label, ok := labelmap[labelId]; ok && label.Name != "" {
+			return label.Name
+		}
+		return labelId
+	}
+	describe := func(filter CadFilter) string {
+		node, _ := CriteriaNode(*filter.Criteria)
+		return fmt.Sprintf("%s (%s)", filter.Id, node.String())
+	}
+
+	if actionIncludes(*broad.Action, *narrow.Action) {
+		return &CadFilterRelationship{
+			Kind:    ShadowedFilterRelationship,
+			Filter:  narrow,
+			Broader: broad,
+			Explanation: fmt.Sprintf(
+				"%s is redundant: %s matches the same mail and already applies its actions",
+				describe(narrow),
+				describe(broad),
+			),
+			Suggestion: deleteFilterSuggestion(narrow, "Shadowed filter identified by the doctor"),
+		}
+	}
+
+	conflicts := conflictingLabelIds(*narrow.Action, *broad.Action)
+	if len(conflicts) > 0 {
+		names := []string{}
+		for _, labelId := range conflicts {
+			names = append(names, labelName(labelId))
+		}
+		return &CadFilterRelationship{
+			Kind:    ConflictingFiltersRelationship,
+			Filter:  narrow,
+			Broader: broad,
+			Explanation: fmt.Sprintf(
+				"%s and %s match the same mail with contradictory actions on %s",
+				describe(narrow),
+				describe(broad),
+				strings.Join(names, ", "),
+			),
+			Suggestion: withoutLabelsSuggestion(narrow, conflicts, "Conflicting filter identified by the doctor"),
+		}
+	}
+
+	narrowUserLabels := userLabelIds(narrow.Action.AddLabelIds, labelmap)
+	broadUserLabels := userLabelIds(broad.Action.AddLabelIds, labelmap)
+	if len(narrowUserLabels) > 0 && len(broadUserLabels) > 0 && !sameStrings(narrowUserLabels, broadUserLabels) {
+		names := []string{}
+		for _, labelId := range append(narrowUserLabels, broadUserLabels...) {
+			names = append(names, labelName(labelId))
+		}
+		// Deleting the narrower filter would drop its label and merging the label into the
+		// broader filter would apply it to more mail, so which label to keep is left to the user
+		return &CadFilterRelationship{
+			Kind:    MultipleUserLabelsRelationship,
+			Filter:  narrow,
+			Broader: broad,
+			Explanation: fmt.Sprintf(
+				"%s and %s apply several user labels (%s) to the same mail",
+				describe(narrow),
+				describe(broad),
+				strings.Join(names, ", "),
+			),
+		}
+	}
+
+	return nil
+}
+
+// queryCovers reports whether every message matching b also matches a
+func queryCovers(a *CadQueryNode, b *CadQueryNode) bool {
+	if a.Kind == QueryAnd {
+		for _, child := range a.Children {
+			if !queryCovers(child, b) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if b.Kind == QueryOr {
+		for _, child := range b.Children {
+			if !queryCovers(a, child) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if a.Kind == QueryOr {
+		for _, child := range a.Children {
+			if queryCovers(child, b) {
+				return true
+			}
+		}
+	}
+
+	if b.Kind == QueryAnd {
+		for _, child := range b.Children {
+			if queryCovers(a, child) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if a.Kind == QueryNot && b.Kind == QueryNot {
+		return queryCovers(b.Children[0], a.Children[0])
+	}
+
+	if a.Kind == QueryTerm && b.Kind == QueryTerm {
+		return termCovers(a, b)
+	}
+
+	return false
+}
+
+func termCovers(a *CadQueryNode, b *CadQueryNode) bool {
+	switch a.Operator {
+	case "":
+		switch b.Operator {
+		case "", "from", "cc", "subject":
+			return wordsCover(a.Value, b.Value)
+		}
+		return false
+	case "from", "to", "cc", "bcc", "deliveredto", "list":
+		return a.Operator == b.Operator && addressCovers(a.Value, b.Value)
+	case "subject", "filename":
+		return a.Operator == b.Operator && wordsCover(a.Value, b.Value)
+	case "larger", "smaller":
+		if a.Operator != b.Operator {
+			return false
+		}
+		aSize, aErr := parseQuerySize(a.Value)
+		bSize, bErr := parseQuerySize(b.Value)
+		if aErr != nil || bErr != nil {
+			return false
+		}
+		if a.Operator == "larger" {
+			return bSize >= aSize
+		}
+		return bSize <= aSize
+	}
+
+	return a.Operator == b.Operator && a.Value == b.Value
+}
+
+// addressCovers reports whether every address matching a also matches b: the same
+// address, or a domain (optionally starting with @) and an address or subdomain in it.
+// bob@x.com does not cover jimbob@x.com.
+func addressCovers(a string, b string) bool {
+	a = strings.ToLower(a)
+	b = strings.ToLower(b)
+	if a == b {
+		return true
+	}
+	if strings.Contains(a, "@") && !strings.HasPrefix(a, "@") {
+		return false
+	}
+	domain := strings.TrimPrefix(a, "@")
+	return domain != "" && (strings.HasSuffix(b, "@"+domain) || strings.HasSuffix(b, "."+domain))
+}
+
+// wordsCover reports whether the words of a appear in that order in b, so sale covers
+// "summer sale" but not wholesale
+func wordsCover(a string, b string) bool {
+	aWords := queryWords(a)
+	bWords := queryWords(b)
+	if len(aWords) == 0 {
+		return false
+	}
+	phrase := strings.Join(aWords, " ")
+	for i := 0; i+len(aWords) <= len(bWords); i++ {
+		if strings.Join(bWords[i:i+len(aWords)], " ") == phrase {
+			return true
+		}
+	}
+	return false
+}
+
+func queryWords(value string) []string {
+	return strings.FieldsFunc(strings.ToLower(value), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// actionIncludes reports whether the broad action already does everything the narrow action does
+func actionIncludes(broad CadAction, narrow CadAction) bool {
+	if narrow.Forward != "" && narrow.Forward != broad.Forward {
+		return false
+	}
+	return subsetOf(narrow.AddLabelIds, broad.AddLabelIds) &&
+		subsetOf(narrow.RemoveLabelIds, broad.RemoveLabelIds)
+}
+
+// conflictingLabelIds returns the labels that one action adds while the other
+// removes, and flags archiving alongside marking mail important or starred
+func conflictingLabelIds(a CadAction, b CadAction) []string {
+	conflicts := map[string]bool{}
+	for _, labelId := range a.AddLabelIds {
+		if contains(b.RemoveLabelIds, labelId) {
+			conflicts[labelId] = true
+		}
+	}
+	for _, labelId := range b.AddLabelIds {
+		if contains(a.RemoveLabelIds, labelId) {
+			conflicts[labelId] = true
+		}
+	}
+
+	archives := func(action CadAction) bool { return contains(action.RemoveLabelIds, "INBOX") }
+	for _, highlight := range []string{"IMPORTANT", "STARRED"} {
+		if (archives(a) && contains(b.AddLabelIds, highlight)) ||
+			(archives(b) && contains(a.AddLabelIds, highlight)) {
+			conflicts["INBOX"] = true
+			conflicts[highlight] = true
+		}
+	}
+
+	return sortedKeys(conflicts)
+}
+
+func deleteFilterSuggestion(filter CadFilter, reason string) *CadRawMigration {
+	operation := DeleteFilterMigration
+	note := fmt.Sprintf("%s (filter %s)", reason, filter.Id)
+	id := filter.Id
+	return &CadRawMigration{
+		Operation: &operation,
+		Details:   CadDeleteFilterMigration{Id: &id},
+		Note:      &note,
+	}
+}
+
+func withoutLabelsSuggestion(filter CadFilter, labelIds []string, reason string) *CadRawMigration {
+	action := &CadAction{Forward: filter.Action.Forward}
+	for _, labelId := range filter.Action.AddLabelIds {
+		if !contains(labelIds, labelId) {
+			action.AddLabelIds = append(action.AddLabelIds, labelId)
+		}
+	}
+	for _, labelId := range filter.Action.RemoveLabelIds {
+		if !contains(labelIds, labelId) {
+			action.RemoveLabelIds = append(action.RemoveLabelIds, labelId)
+		}
+	}
+	if len(action.AddLabelIds) == 0 && len(action.RemoveLabelIds) == 0 && action.Forward == "" {
+		return deleteFilterSuggestion(filter, reason)
+	}
+
+	operation := ReplaceFiltersMigration
+	note := fmt.Sprintf("%s (filter %s)", reason, filter.Id)
+	ids := []string{filter.Id}
+	return &CadRawMigration{
+		Operation: &operation,
+		Details:   CadReplaceFiltersMigration{Ids: &ids, Action: action},
+		Note:      &note,
+	}
+}
+
+func userLabelIds(labelIds []string, labelmap map[string]CadLabel) []string {
+	userLabels := []string{}
+	for _, labelId := range labelIds {
+		if labelmap[labelId].Type == user {
+			userLabels = append(userLabels, labelId)
+		}
+	}
+	return userLabels
+}
+
+func subsetOf(a []string, b []string) bool {
+	for _, v := range a {
+		if !contains(b, v) {
+			return false
+		}
+	}
+	return true
+}
+
+func sameStrings(a []string, b []string) bool {
+	return subsetOf(a, b) && subsetOf(b, a)
+}
+
+func contains(s []string, str string) bool {
+	for _, v := range s {
+		if v == str {
+			return true
+		}
+	}
+	return false
+}
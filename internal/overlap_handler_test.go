@@ -0,0 +1,108 @@
+package internal
+
+import "testing"
+
+func TestFilterRelationship(t *testing.T) {
+	labelmap := map[string]CadLabel{
+		"Label_1": {Id: "Label_1", Name: "News", Type: user},
+		"Label_2": {Id: "Label_2", Name: "News/Weekly", Type: user},
+		"INBOX":   {Id: "INBOX", Name: "INBOX", Type: "system"},
+	}
+	broad := CadFilter{
+		Id:       "broad",
+		Criteria: &CadCriteria{From: "news.x.com"},
+		Action:   &CadAction{AddLabelIds: []string{"Label_1"}},
+	}
+
+	tests := []struct {
+		name           string
+		action         CadAction
+		kind           string
+		wantSuggestion bool
+	}{
+		{name: "shadowed", action: CadAction{AddLabelIds: []string{"Label_1"}, RemoveLabelIds: []string{}}, kind: ShadowedFilterRelationship, wantSuggestion: true},
+		{name: "multiple labels", action: CadAction{AddLabelIds: []string{"Label_2"}}, kind: MultipleUserLabelsRelationship, wantSuggestion: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			action := tt.action
+			narrow := CadFilter{
+				Id:       "narrow",
+				Criteria: &CadCriteria{From: "weekly@news.x.com", Subject: "digest"},
+				Action:   &action,
+			}
+			relationship := filterRelationship(narrow, broad, labelmap)
+			if relationship == nil || relationship.Kind != tt.kind {
+				t.Fatalf("filterRelationship() = %v, want %s", relationship, tt.kind)
+			}
+			if got := relationship.Suggestion != nil; got != tt.wantSuggestion {
+				t.Errorf("filterRelationship() suggestion = %v, want %v", got, tt.wantSuggestion)
+			}
+		})
+	}
+}
+
+func TestTermCovers(t *testing.T) {
+	tests := []struct {
+		name string
+		a    CadQueryNode
+		b    CadQueryNode
+		want bool
+	}{
+		{name: "same address", a: CadQueryNode{Operator: "from", Value: "bob@x.com"}, b: CadQueryNode{Operator: "from", Value: "Bob@x.com"}, want: true},
+		{name: "address in a longer address", a: CadQueryNode{Operator: "from", Value: "bob@x.com"}, b: CadQueryNode{Operator: "from", Value: "jimbob@x.com"}, want: false},
+		{name: "domain", a: CadQueryNode{Operator: "from", Value: "x.com"}, b: CadQueryNode{Operator: "from", Value: "bob@x.com"}, want: true},
+		{name: "at domain", a: CadQueryNode{Operator: "from", Value: "@x.com"}, b: CadQueryNode{Operator: "from", Value: "bob@x.com"}, want: true},
+		{name: "subdomain", a: CadQueryNode{Operator: "list", Value: "x.com"}, b: CadQueryNode{Operator: "list", Value: "news.x.com"}, want: true},
+		{name: "domain in a longer domain", a: CadQueryNode{Operator: "from", Value: "x.com"}, b: CadQueryNode{Operator: "from", Value: "bob@linux.com"}, want: false},
+		{name: "other operator", a: CadQueryNode{Operator: "to", Value: "bob@x.com"}, b: CadQueryNode{Operator: "from", Value: "bob@x.com"}, want: false},
+		{name: "subject word", a: CadQueryNode{Operator: "subject", Value: "sale"}, b: CadQueryNode{Operator: "subject", Value: "summer sale"}, want: true},
+		{name: "subject word in a longer word", a: CadQueryNode{Operator: "subject", Value: "sale"}, b: CadQueryNode{Operator: "subject", Value: "wholesale"}, want: false},
+		{name: "subject phrase", a: CadQueryNode{Operator: "subject", Value: "weekly digest", Phrase: true}, b: CadQueryNode{Operator: "subject", Value: "your weekly digest", Phrase: true}, want: true},
+		{name: "subject words in another order", a: CadQueryNode{Operator: "subject", Value: "weekly digest", Phrase: true}, b: CadQueryNode{Operator: "subject", Value: "digest weekly", Phrase: true}, want: false},
+		{name: "bare word in an address", a: CadQueryNode{Value: "x"}, b: CadQueryNode{Operator: "from", Value: "bob@x.com"}, want: true},
+		{name: "bare word in a longer word", a: CadQueryNode{Value: "bob"}, b: CadQueryNode{Operator: "from", Value: "jimbob@x.com"}, want: false},
+		{name: "larger", a: CadQueryNode{Operator: "larger", Value: "1m"}, b: CadQueryNode{Operator: "larger", Value: "5m"}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.a.Kind = QueryTerm
+			tt.b.Kind = QueryTerm
+			if got := termCovers(&tt.a, &tt.b); got != tt.want {
+				t.Errorf("termCovers(%s, %s) = %v, want %v", tt.a.String(), tt.b.String(), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryCoversCriteria(t *testing.T) {
+	tests := []struct {
+		name   string
+		broad  CadCriteria
+		narrow CadCriteria
+		want   bool
+	}{
+		{name: "sender and subject", broad: CadCriteria{From: "news.x.com"}, narrow: CadCriteria{From: "weekly@news.x.com", Subject: "digest"}, want: true},
+		{name: "one of the senders", broad: CadCriteria{From: "a@x.com OR b@x.com"}, narrow: CadCriteria{From: "b@x.com"}, want: true},
+		{name: "longer address", broad: CadCriteria{From: "bob@x.com"}, narrow: CadCriteria{From: "jimbob@x.com"}, want: false},
+		{name: "longer subject word", broad: CadCriteria{Subject: "sale"}, narrow: CadCriteria{Subject: "wholesale"}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broad, err := CriteriaNode(tt.broad)
+			if err != nil {
+				t.Fatal(err)
+			}
+			narrow, err := CriteriaNode(tt.narrow)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := queryCovers(broad, narrow); got != tt.want {
+				t.Errorf("queryCovers(%s, %s) = %v, want %v", broad.String(), narrow.String(), got, tt.want)
+			}
+		})
+	}
+}
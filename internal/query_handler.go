@@ -0,0 +1,488 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const QueryAnd string = "and"
+const QueryOr string = "or"
+const QueryNot string = "not"
+const QueryTerm string = "term"
+
+// CadQueryNode is a node in the parsed representation of a Gmail search query
+type CadQueryNode struct {
+	Kind     string          `json:"kind"`
+	Operator string          `json:"operator,omitempty"`
+	Value    string          `json:"value,omitempty"`
+	Phrase   bool            `json:"phrase,omitempty"`
+	Children []*CadQueryNode `json:"children,omitempty"`
+}
+
+const (
+	tokenWord = iota
+	tokenPhrase
+	tokenOr
+	tokenMinus
+	tokenLParen
+	tokenRParen
+	tokenLBrace
+	tokenRBrace
+)
+
+type queryToken struct {
+	kind  int
+	value string
+	pos   int
+}
+
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+}
+
+// ParseQuery parses a Gmail search query into a tree of CadQueryNodes
+func ParseQuery(query string) (*CadQueryNode, error) {
+	tokens, err := tokenizeQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tokens) == 0 {
+		return &CadQueryNode{Kind: QueryAnd}, nil
+	}
+
+	p := &queryParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		t := p.tokens[p.pos]
+		return nil, fmt.Errorf("unexpected %q at position %d", t.value, t.pos)
+	}
+
+	return node, nil
+}
+
+// ParseCriteriaValue parses a filter criteria field (such as From or To),
+// applying the operator implied by the field to any bare terms
+func ParseCriteriaValue(value string, operator string) (*CadQueryNode, error) {
+	node, err := ParseQuery(value)
+	if err != nil {
+		return nil, err
+	}
+	node.setDefaultOperator(operator)
+
+	return node, nil
+}
+
+func tokenizeQuery(query string) ([]queryToken, error) {
+	tokens := []queryToken{}
+	runes := []rune(query)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, queryToken{kind: tokenLParen, value: "(", pos: i})
+			i++
+		case r == ')':
+			tokens = append(tokens, queryToken{kind: tokenRParen, value: ")", pos: i})
+			i++
+		case r == '{':
+			tokens = append(tokens, queryToken{kind: tokenLBrace, value: "{", pos: i})
+			i++
+		case r == '}':
+			tokens = append(tokens, queryToken{kind: tokenRBrace, value: "}", pos: i})
+			i++
+		case r == '-' && i+1 < len(runes) && !unicode.IsSpace(runes[i+1]):
+			tokens = append(tokens, queryToken{kind: tokenMinus, value: "-", pos: i})
+			i++
+		case r == '"' || (r == '\\' && i+1 < len(runes) && runes[i+1] == '"'):
+			// Quotes are sometimes stored escaped (\"), treat them as plain quotes
+			start := i
+			if r == '\\' {
+				i++
+			}
+			i++
+			phrase := []rune{}
+			closed := false
+			for i < len(runes) {
+				if runes[i] == '\\' && i+1 < len(runes) && runes[i+1] == '"' {
+					i += 2
+					closed = true
+					break
+				}
+				if runes[i] == '"' {
+					i++
+					closed = true
+					break
+				}
+				phrase = append(phrase, runes[i])
+				i++
+			}
+			if !closed {
+				return nil, fmt.Errorf("unterminated quote at position %d", start)
+			}
+			tokens = append(tokens, queryToken{kind: tokenPhrase, value: string(phrase), pos: start})
+		default:
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && !strings.ContainsRune("(){}\"", runes[i]) {
+				if runes[i] == '\\' && i+1 < len(runes) && runes[i+1] == '"' {
+					break
+				}
+				i++
+			}
+			word := string(runes[start:i])
+			if word == "OR" || word == "|" {
+				tokens = append(tokens, queryToken{kind: tokenOr, value: word, pos: start})
+			} else if word != "AND" {
+				tokens = append(tokens, queryToken{kind: tokenWord, value: word, pos: start})
+			}
+		}
+	}
+
+	return tokens, nil
+}
+
+func (p *queryParser) peek() *queryToken {
+	if p.pos >= len(p.tokens) {
+		return nil
+	}
+	return &p.tokens[p.pos]
+}
+
+func (p *queryParser) parseOr() (*CadQueryNode, error) {
+	first, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	children := []*CadQueryNode{first}
+	for t := p.peek(); t != nil && t.kind == tokenOr; t = p.peek() {
+		p.pos++
+		next, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, next)
+	}
+
+	if len(children) == 1 {
+		return first, nil
+	}
+	return &CadQueryNode{Kind: QueryOr, Children: children}, nil
+}
+
+func (p *queryParser) parseAnd() (*CadQueryNode, error) {
+	children := []*CadQueryNode{}
+	for t := p.peek(); t != nil && t.kind != tokenOr && t.kind != tokenRParen && t.kind != tokenRBrace; t = p.peek() {
+		child, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+	}
+
+	if len(children) == 0 {
+		if t := p.peek(); t != nil {
+			return nil, fmt.Errorf("unexpected %q at position %d", t.value, t.pos)
+		}
+		return nil, fmt.Errorf("unexpected end of query")
+	}
+	if len(children) == 1 {
+		return children[0], nil
+	}
+	return &CadQueryNode{Kind: QueryAnd, Children: children}, nil
+}
+
+func (p *queryParser) parseUnary() (*CadQueryNode, error) {
+	t := p.peek()
+	if t != nil && t.kind == tokenMinus {
+		p.pos++
+		child, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &CadQueryNode{Kind: QueryNot, Children: []*CadQueryNode{child}}, nil
+	}
+
+	return p.parsePrimary()
+}
+
+func (p *queryParser) parsePrimary() (*CadQueryNode, error) {
+	t := p.peek()
+	if t == nil {
+		return nil, fmt.Errorf("unexpected end of query")
+	}
+
+	switch t.kind {
+	case tokenLParen:
+		p.pos++
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokenRParen, ")", t.pos); err != nil {
+			return nil, err
+		}
+		return node, nil
+	case tokenLBrace:
+		// {a b c} is Gmail shorthand for (a OR b OR c)
+		p.pos++
+		children := []*CadQueryNode{}
+		for next := p.peek(); next != nil && next.kind != tokenRBrace; next = p.peek() {
+			if next.kind == tokenOr {
+				p.pos++
+				continue
+			}
+			child, err := p.parseUnary()
+			if err != nil {
+				return nil, err
+			}
+			children = append(children, child)
+		}
+		if err := p.expect(tokenRBrace, "}", t.pos); err != nil {
+			return nil, err
+		}
+		if len(children) == 0 {
+			return nil, fmt.Errorf("empty group at position %d", t.pos)
+		}
+		if len(children) == 1 {
+			return children[0], nil
+		}
+		return &CadQueryNode{Kind: QueryOr, Children: children}, nil
+	case tokenPhrase:
+		p.pos++
+		return &CadQueryNode{Kind: QueryTerm, Value: t.value, Phrase: true}, nil
+	case tokenWord:
+		p.pos++
+		operator, value, ok := splitOperator(t.value)
+		if !ok {
+			return &CadQueryNode{Kind: QueryTerm, Value: t.value}, nil
+		}
+		if value != "" {
+			return &CadQueryNode{Kind: QueryTerm, Operator: operator, Value: value}, nil
+		}
+
+		// The operator applies to the quoted phrase or group that follows it
+		next := p.peek()
+		if next == nil || (next.kind != tokenPhrase && next.kind != tokenLParen && next.kind != tokenLBrace) {
+			return nil, fmt.Errorf("missing value for operator %s: at position %d", operator, t.pos)
+		}
+		node, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		node.setDefaultOperator(operator)
+		return node, nil
+	default:
+		return nil, fmt.Errorf("unexpected %q at position %d", t.value, t.pos)
+	}
+}
+
+// isSingleQueryPrimary reports whether a query is a single term, phrase or group, such
+// as a@x.com, "a b" or (a OR b). The parsed tree does not keep the parentheses, so the
+// tokens are checked against a single primary instead.
+func isSingleQueryPrimary(query string) (bool, error) {
+	tokens, err := tokenizeQuery(query)
+	if err != nil {
+		return false, err
+	}
+	if len(tokens) == 0 {
+		return true, nil
+	}
+
+	p := &queryParser{tokens: tokens}
+	if _, err := p.parsePrimary(); err != nil {
+		// Not a primary, eg a negation, check the whole query is valid
+		if _, err := ParseQuery(query); err != nil {
+			return false, err
+		}
+		return false, nil
+	}
+	return p.pos == len(p.tokens), nil
+}
+
+func (p *queryParser) expect(kind int, value string, openedAt int) error {
+	t := p.peek()
+	if t == nil || t.kind != kind {
+		return fmt.Errorf("missing %q for group opened at position %d", value, openedAt)
+	}
+	p.pos++
+	return nil
+}
+
+func splitOperator(word string) (string, string, bool) {
+	idx := strings.Index(word, ":")
+	if idx <= 0 {
+		return "", "", false
+	}
+
+	operator := word[:idx]
+	for _, r := range operator {
+		if !unicode.IsLetter(r) && r != '_' && r != '-' {
+			return "", "", false
+		}
+	}
+
+	return strings.ToLower(operator), word[idx+1:], true
+}
+
+func (node *CadQueryNode) setDefaultOperator(operator string) {
+	if node.Kind == QueryTerm {
+		if node.Operator == "" {
+			node.Operator = operator
+		}
+		return
+	}
+	for _, child := range node.Children {
+		child.setDefaultOperator(operator)
+	}
+}
+
+// knownOperators are the search operators Gmail documents for filters and searches
+var knownOperators = map[string]bool{
+	"after":       true,
+	"bcc":         true,
+	"before":      true,
+	"category":    true,
+	"cc":          true,
+	"deliveredto": true,
+	"filename":    true,
+	"from":        true,
+	"has":         true,
+	"in":          true,
+	"is":          true,
+	"label":       true,
+	"larger":      true,
+	"list":        true,
+	"newer":       true,
+	"newer_than":  true,
+	"older":       true,
+	"older_than":  true,
+	"rfc822msgid": true,
+	"size":        true,
+	"smaller":     true,
+	"subject":     true,
+	"to":          true,
+}
+
+// NormalizeQuery returns a canonical form of the query so that equivalent
+// queries compare equal. Queries that fail to parse are only trimmed and lower cased.
+func NormalizeQuery(query string) string {
+	node, err := ParseQuery(query)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(query))
+	}
+	return node.Normalize().String()
+}
+
+// LintQuery returns the problems found in a query: syntax errors and unknown operators
+func LintQuery(query string) []string {
+	node, err := ParseQuery(query)
+	if err != nil {
+		return []string{fmt.Sprintf("syntax error: %v", err)}
+	}
+
+	problems := []string{}
+	node.walk(func(n *CadQueryNode) {
+		if n.Kind == QueryTerm && n.Operator != "" && !knownOperators[n.Operator] {
+			problems = append(problems, fmt.Sprintf("unknown operator %s:", n.Operator))
+		}
+	})
+	return problems
+}
+
+// Normalize lower cases terms, flattens nested groups, removes duplicates and sorts
+// the operands of every AND and OR
+func (node *CadQueryNode) Normalize() *CadQueryNode {
+	switch node.Kind {
+	case QueryTerm:
+		return &CadQueryNode{
+			Kind:     QueryTerm,
+			Operator: strings.ToLower(node.Operator),
+			Value:    strings.ToLower(node.Value),
+			Phrase:   node.Phrase && strings.ContainsAny(node.Value, " \t"),
+		}
+	case QueryNot:
+		child := node.Children[0].Normalize()
+		if child.Kind == QueryNot {
+			return child.Children[0]
+		}
+		return &CadQueryNode{Kind: QueryNot, Children: []*CadQueryNode{child}}
+	}
+
+	seen := map[string]bool{}
+	children := []*CadQueryNode{}
+	for _, child := range node.Children {
+		normalized := child.Normalize()
+		grandchildren := []*CadQueryNode{normalized}
+		if normalized.Kind == node.Kind {
+			grandchildren = normalized.Children
+		}
+		for _, grandchild := range grandchildren {
+			key := grandchild.String()
+			if !seen[key] {
+				seen[key] = true
+				children = append(children, grandchild)
+			}
+		}
+	}
+
+	if len(children) == 1 {
+		return children[0]
+	}
+	sort.SliceStable(children, func(i, j int) bool {
+		return children[i].String() < children[j].String()
+	})
+	return &CadQueryNode{Kind: node.Kind, Children: children}
+}
+
+// String renders the tree back into Gmail search syntax
+func (node *CadQueryNode) String() string {
+	switch node.Kind {
+	case QueryTerm:
+		value := node.Value
+		if node.Phrase {
+			value = fmt.Sprintf("\"%s\"", value)
+		}
+		if node.Operator == "" {
+			return value
+		}
+		return fmt.Sprintf("%s:%s", node.Operator, value)
+	case QueryNot:
+		return "-" + node.Children[0].groupString()
+	case QueryOr:
+		parts := []string{}
+		for _, child := range node.Children {
+			parts = append(parts, child.groupString())
+		}
+		return strings.Join(parts, " OR ")
+	default:
+		parts := []string{}
+		for _, child := range node.Children {
+			parts = append(parts, child.groupString())
+		}
+		return strings.Join(parts, " ")
+	}
+}
+
+func (node *CadQueryNode) groupString() string {
+	if (node.Kind == QueryAnd || node.Kind == QueryOr) && len(node.Children) > 1 {
+		return fmt.Sprintf("(%s)", node.String())
+	}
+	return node.String()
+}
+
+func (node *CadQueryNode) walk(visit func(*CadQueryNode)) {
+	visit(node)
+	for _, child := range node.Children {
+		child.walk(visit)
+	}
+}
@@ -0,0 +1,200 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenizeQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		kinds []int
+		words []string
+	}{
+		{query: "from:a@x.com", kinds: []int{tokenWord}, words: []string{"from:a@x.com"}},
+		{query: `subject:"weekly digest"`, kinds: []int{tokenWord, tokenPhrase}, words: []string{"subject:", "weekly digest"}},
+		{query: `subject:\"weekly digest\"`, kinds: []int{tokenWord, tokenPhrase}, words: []string{"subject:", "weekly digest"}},
+		{query: "-from:a a-b", kinds: []int{tokenMinus, tokenWord, tokenWord}, words: []string{"-", "from:a", "a-b"}},
+		{query: "a - b", kinds: []int{tokenWord, tokenWord, tokenWord}, words: []string{"a", "-", "b"}},
+		{query: "a OR b | c AND d", kinds: []int{tokenWord, tokenOr, tokenWord, tokenOr, tokenWord, tokenWord}, words: []string{"a", "OR", "b", "|", "c", "d"}},
+		{query: "a or b", kinds: []int{tokenWord, tokenWord, tokenWord}, words: []string{"a", "or", "b"}},
+		{query: "({a b})", kinds: []int{tokenLParen, tokenLBrace, tokenWord, tokenWord, tokenRBrace, tokenRParen}, words: []string{"(", "{", "a", "b", "}", ")"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			tokens, err := tokenizeQuery(tt.query)
+			if err != nil {
+				t.Fatalf("tokenizeQuery() error = %v", err)
+			}
+			kinds, words := []int{}, []string{}
+			for _, token := range tokens {
+				kinds = append(kinds, token.kind)
+				words = append(words, token.value)
+			}
+			if !reflect.DeepEqual(kinds, tt.kinds) || !reflect.DeepEqual(words, tt.words) {
+				t.Errorf("tokenizeQuery() = %v %q, want %v %q", kinds, words, tt.kinds, tt.words)
+			}
+		})
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    string
+		wantErr bool
+	}{
+		{name: "empty", query: "  ", want: ""},
+		{name: "term", query: "from:a@x.com", want: "from:a@x.com"},
+		{name: "operator is lower cased", query: "FROM:a@x.com", want: "from:a@x.com"},
+		{name: "and", query: "from:a subject:b", want: "from:a subject:b"},
+		{name: "explicit and", query: "from:a AND subject:b", want: "from:a subject:b"},
+		{name: "or binds looser than and", query: "a b OR c", want: "(a b) OR c"},
+		{name: "pipe", query: "a | b", want: "a OR b"},
+		{name: "negation", query: "-a b", want: "-a b"},
+		{name: "double negation", query: "--a", want: "--a"},
+		{name: "negated group", query: "-(a OR b)", want: "-(a OR b)"},
+		{name: "braces are an OR", query: "{a b c}", want: "a OR b OR c"},
+		{name: "single brace term", query: "{a}", want: "a"},
+		{name: "nested parentheses", query: "((a OR (b c)) d)", want: "(a OR (b c)) d"},
+		{name: "phrase", query: `"a b"`, want: `"a b"`},
+		{name: "operator on a phrase", query: `subject:"a b"`, want: `subject:"a b"`},
+		{name: "operator on a group", query: "from:(a OR b)", want: "from:a OR from:b"},
+		{name: "operator on braces", query: "to:{a b}", want: "to:a OR to:b"},
+		{name: "operator keeps inner operators", query: "from:(a subject:b)", want: "from:a subject:b"},
+		{name: "url is not an operator", query: "http://x.com", want: "http://x.com"},
+		{name: "unterminated quote", query: `subject:"a b`, wantErr: true},
+		{name: "missing parenthesis", query: "(a b", wantErr: true},
+		{name: "missing brace", query: "{a b", wantErr: true},
+		{name: "extra parenthesis", query: "a b)", wantErr: true},
+		{name: "empty group", query: "{}", wantErr: true},
+		{name: "dangling or", query: "a OR", wantErr: true},
+		{name: "operator without value", query: "from: a", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, err := ParseQuery(tt.query)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ParseQuery(%q) = %s, want an error", tt.query, node.String())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseQuery(%q) error = %v", tt.query, err)
+			}
+			if got := node.String(); got != tt.want {
+				t.Errorf("ParseQuery(%q) = %q, want %q", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{name: "lower cases", query: "From:A@X.com", want: "from:a@x.com"},
+		{name: "sorts and", query: "subject:b from:a", want: "from:a subject:b"},
+		{name: "sorts or", query: "c OR a OR b", want: "a OR b OR c"},
+		{name: "braces and or", query: "{b a}", want: "a OR b"},
+		{name: "removes duplicates", query: "a a OR a", want: "a"},
+		{name: "flattens nested groups", query: "(a (b c)) d", want: "a b c d"},
+		{name: "flattens nested or", query: "a OR (b OR c)", want: "a OR b OR c"},
+		{name: "keeps or inside and", query: "z (b OR a)", want: "(a OR b) z"},
+		{name: "removes double negation", query: "--a", want: "a"},
+		{name: "single word phrase", query: `"Sale"`, want: "sale"},
+		{name: "phrase", query: `subject:"Weekly  Digest"`, want: `subject:"weekly  digest"`},
+		{name: "operator group", query: "from:(b@x.com OR a@x.com)", want: "from:a@x.com OR from:b@x.com"},
+		{name: "syntax error is trimmed and lower cased", query: " (A ", want: "(a"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NormalizeQuery(tt.query); got != tt.want {
+				t.Errorf("NormalizeQuery(%q) = %q, want %q", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLintQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{name: "valid", query: "from:a@x.com has:attachment older_than:1y", want: []string{}},
+		{name: "unknown operator", query: "sender:a@x.com", want: []string{"unknown operator sender:"}},
+		{name: "unknown operators in groups", query: "-(foo:a OR bar:b)", want: []string{"unknown operator foo:", "unknown operator bar:"}},
+		{name: "syntax error", query: "(a", want: []string{`syntax error: missing ")" for group opened at position 0`}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := LintQuery(tt.query); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("LintQuery(%q) = %q, want %q", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchCriteria(t *testing.T) {
+	facts := &CadMessageFacts{
+		From:          "Weekly News <news@shop.example>",
+		To:            "me@x.com",
+		Cc:            "team@x.com",
+		Subject:       "Your weekly digest",
+		ListId:        "<news.shop.example>",
+		Body:          "Click here to unsubscribe",
+		Filenames:     []string{"invoice.pdf"},
+		HasAttachment: true,
+		Size:          2 * 1024 * 1024,
+	}
+
+	tests := []struct {
+		name     string
+		criteria CadCriteria
+		want     bool
+	}{
+		{name: "empty", criteria: CadCriteria{}, want: true},
+		{name: "from", criteria: CadCriteria{From: "news@shop.example"}, want: true},
+		{name: "from case", criteria: CadCriteria{From: "NEWS@shop.example"}, want: true},
+		{name: "from other", criteria: CadCriteria{From: "deals@shop.example"}, want: false},
+		{name: "from one of", criteria: CadCriteria{From: "deals@shop.example OR news@shop.example"}, want: true},
+		{name: "to matches cc", criteria: CadCriteria{To: "team@x.com"}, want: true},
+		{name: "subject phrase", criteria: CadCriteria{Subject: `"weekly digest"`}, want: true},
+		{name: "subject words", criteria: CadCriteria{Subject: "digest weekly"}, want: true},
+		{name: "subject missing word", criteria: CadCriteria{Subject: "monthly digest"}, want: false},
+		{name: "list", criteria: CadCriteria{Query: "list:news.shop.example"}, want: true},
+		{name: "body word", criteria: CadCriteria{Query: "unsubscribe"}, want: true},
+		{name: "negated query", criteria: CadCriteria{From: "shop.example", NegatedQuery: "unsubscribe"}, want: false},
+		{name: "negated query without match", criteria: CadCriteria{From: "shop.example", NegatedQuery: "urgent"}, want: true},
+		{name: "filename", criteria: CadCriteria{Query: "filename:pdf"}, want: true},
+		{name: "has attachment", criteria: CadCriteria{HasAttachment: true}, want: true},
+		{name: "larger", criteria: CadCriteria{Size: 1024 * 1024, SizeComparison: "larger"}, want: true},
+		{name: "smaller", criteria: CadCriteria{Size: 1024 * 1024, SizeComparison: "smaller"}, want: false},
+		{name: "size units", criteria: CadCriteria{Query: "larger:1m smaller:3m"}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := MatchCriteria(tt.criteria, facts)
+			if err != nil {
+				t.Fatalf("MatchCriteria() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("MatchCriteria(%q) = %v, want %v", CriteriaQuery(tt.criteria), got, tt.want)
+			}
+		})
+	}
+
+	if _, err := MatchCriteria(CadCriteria{Query: "(a"}, facts); err == nil {
+		t.Errorf("MatchCriteria() accepted a query with a syntax error")
+	}
+}
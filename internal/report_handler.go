@@ -0,0 +1,394 @@
+package internal
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+const SenderReportBySender string = "sender"
+const SenderReportByDomain string = "domain"
+
+// CadSenderStats aggregates the messages of a sender address or domain. Filtered is the
+// number of its messages matched by a local filter and FilterId the filter matching
+// the most of them, if any.
+type CadSenderStats struct {
+	Sender        string  `json:"sender"`
+	Messages      int     `json:"messages"`
+	Unread        int     `json:"unread"`
+	Inbox         int     `json:"inbox"`
+	Filtered      int     `json:"filtered"`
+	UnreadRatio   float64 `json:"unreadRatio"`
+	InboxShare    float64 `json:"inboxShare"`
+	FilteredShare float64 `json:"filteredShare"`
+	FilterId      string  `json:"filterId,omitempty"`
+}
+
+// SenderReport aggregates the messages by sender address or by sender domain, busiest
+// first. Filters are matched against the stored headers of every message, criteria on
+// the body or attachments can not be matched.
+func SenderReport(messages []*CadMessageMeta, by string) ([]CadSenderStats, error) {
+	filters, err := ReadLocalFilters()
+	if err != nil {
+		log.Printf("Unable to read local filters file: %v", err)
+		return nil, err
+	}
+
+	filterNodes := []*CadQueryNode{}
+	filterIds := []string{}
+	for _, filter := range filters {
+		if filter.Criteria == nil {
+			continue
+		}
+		node, err := ParseQuery(CriteriaQuery(*filter.Criteria))
+		if err != nil {
+			continue
+		}
+		filterNodes = append(filterNodes, node)
+		filterIds = append(filterIds, filter.Id)
+	}
+
+	statsBySender := map[string]*CadSenderStats{}
+	filterMatches := map[string]map[string]int{}
+	for _, meta := range messages {
+		sender := MessageSender(meta)
+		if sender == "" {
+			continue
+		}
+		if by == SenderReportByDomain {
+			sender = sender[strings.LastIndex(sender, "@")+1:]
+		}
+
+		stats, ok := statsBySender[sender]
+		if !ok {
+			stats = &CadSenderStats{Sender: sender}
+			statsBySender[sender] = stats
+			filterMatches[sender] = map[string]int{}
+		}
+		stats.Messages++
+		if meta.HasLabel("UNREAD") {
+			stats.Unread++
+		}
+		if meta.HasLabel("INBOX") {
+			stats.Inbox++
+		}
+
+		facts := meta.Facts()
+		filtered := false
+		for i, node := range filterNodes {
+			if node.Match(facts) {
+				filterMatches[sender][filterIds[i]]++
+				filtered = true
+			}
+		}
+		if filtered {
+			stats.Filtered++
+		}
+	}
+
+	report := []CadSenderStats{}
+	for sender, stats := range statsBySender {
+		stats.UnreadRatio = float64(stats.Unread) / float64(stats.Messages)
+		stats.InboxShare = float64(stats.Inbox) / float64(stats.Messages)
+		stats.FilteredShare = float64(stats.Filtered) / float64(stats.Messages)
+		// Filters are visited in order so the first of equally matching filters is kept
+		for _, filterId := range filterIds {
+			if count := filterMatches[sender][filterId]; count > 0 && (stats.FilterId == "" || count > filterMatches[sender][stats.FilterId]) {
+				stats.FilterId = filterId
+			}
+		}
+		report = append(report, *stats)
+	}
+	sort.SliceStable(report, func(i, j int) bool {
+		if report[i].Messages != report[j].Messages {
+			return report[i].Messages > report[j].Messages
+		}
+		return report[i].Sender < report[j].Sender
+	})
+
+	return report, nil
+}
+
+// MessageSender returns the lower case address of the sender of a stored message
+func MessageSender(meta *CadMessageMeta) string {
+	from := meta.Header("From")
+	if from == "" {
+		return ""
+	}
+	return strings.ToLower(extractSenderFromHeader(&gmail.MessagePartHeader{Name: "From", Value: from}))
+}
+
+// messageSenderDomain returns the domain of the sender, or (unknown) without a sender
+func messageSenderDomain(meta *CadMessageMeta) string {
+	sender := MessageSender(meta)
+	if sender == "" {
+		return "(unknown)"
+	}
+	return sender[strings.LastIndex(sender, "@")+1:]
+}
+
+// Message age buckets of the storage report, the last bucket holds everything older
+var storageAgeBuckets = []struct {
+	name string
+	days int
+}{
+	{"under 30 days", 30},
+	{"30 to 90 days", 90},
+	{"90 days to 1 year", 365},
+	{"1 to 2 years", 2 * 365},
+	{"2 to 5 years", 5 * 365},
+	{"over 5 years", 0},
+}
+
+type CadStorageBucket struct {
+	Name     string `json:"name"`
+	Messages int    `json:"messages"`
+	Bytes    int64  `json:"bytes"`
+}
+
+type CadStorageMessage struct {
+	Id      string    `json:"id"`
+	From    string    `json:"from"`
+	Subject string    `json:"subject"`
+	Date    time.Time `json:"date"`
+	Bytes   int64     `json:"bytes"`
+}
+
+// CadStorageReport breaks down the size estimates of messages. A message counts towards
+// each of its labels, so the label buckets add up to more than the total.
+type CadStorageReport struct {
+	Messages int                 `json:"messages"`
+	Bytes    int64               `json:"bytes"`
+	ByLabel  []CadStorageBucket  `json:"byLabel"`
+	ByDomain []CadStorageBucket  `json:"byDomain"`
+	ByAge    []CadStorageBucket  `json:"byAge"`
+	Largest  []CadStorageMessage `json:"largest"`
+}
+
+// StorageMessages returns the stored metadata of the messages with the labels matching
+// the query, or of every stored message when neither is given. Messages missing from
+// the store are fetched.
+func StorageMessages(store *CadMessageStore, labels []*CadLabel, query *string) ([]*CadMessageMeta, error) {
+	if len(labels) == 0 && query == nil {
+		return store.Select(func(meta *CadMessageMeta) bool { return true }), nil
+	}
+
+	ids, err := GetMessagesIDsByLabelIDs(labels, query)
+	if err != nil {
+		return nil, err
+	}
+
+	srv, err := GetService()
+	if err != nil {
+		log.Printf("Unable to retrieve Gmail client: %v", err)
+		return nil, err
+	}
+
+	messages := []*CadMessageMeta{}
+	for _, id := range ids {
+		meta, ok := store.Messages[id]
+		if !ok {
+			meta, err = getMessageMeta(srv, id)
+			if err != nil {
+				return nil, err
+			}
+			if meta == nil {
+				continue
+			}
+		}
+		messages = append(messages, meta)
+	}
+	return messages, nil
+}
+
+// StorageReport aggregates the size estimates of the messages, listing the largest
+// buckets first and the given number of largest messages
+func StorageReport(messages []*CadMessageMeta, labelNames map[string]string, largest int) CadStorageReport {
+	report := CadStorageReport{}
+	byLabel := map[string]*CadStorageBucket{}
+	byDomain := map[string]*CadStorageBucket{}
+	byAge := map[string]*CadStorageBucket{}
+	for _, bucket := range storageAgeBuckets {
+		byAge[bucket.name] = &CadStorageBucket{Name: bucket.name}
+	}
+
+	add := func(buckets map[string]*CadStorageBucket, name string, size int64) {
+		bucket, ok := buckets[name]
+		if !ok {
+			bucket = &CadStorageBucket{Name: name}
+			buckets[name] = bucket
+		}
+		bucket.Messages++
+		bucket.Bytes += size
+	}
+
+	now := time.Now()
+	for _, meta := range messages {
+		report.Messages++
+		report.Bytes += meta.SizeEstimate
+
+		for _, labelId := range meta.LabelIds {
+			name, ok := labelNames[labelId]
+			if !ok {
+				name = labelId
+			}
+			add(byLabel, name, meta.SizeEstimate)
+		}
+
+		add(byDomain, messageSenderDomain(meta), meta.SizeEstimate)
+
+		age := now.Sub(meta.Date())
+		for _, bucket := range storageAgeBuckets {
+			if bucket.days == 0 || age < time.Duration(bucket.days)*24*time.Hour {
+				add(byAge, bucket.name, meta.SizeEstimate)
+				break
+			}
+		}
+	}
+
+	report.ByLabel = sortedStorageBuckets(byLabel)
+	report.ByDomain = sortedStorageBuckets(byDomain)
+	for _, bucket := range storageAgeBuckets {
+		report.ByAge = append(report.ByAge, *byAge[bucket.name])
+	}
+
+	sorted := append([]*CadMessageMeta{}, messages...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].SizeEstimate > sorted[j].SizeEstimate
+	})
+	for i := 0; i < len(sorted) && i < largest; i++ {
+		report.Largest = append(report.Largest, CadStorageMessage{
+			Id:      sorted[i].Id,
+			From:    sorted[i].Header("From"),
+			Subject: sorted[i].Header("Subject"),
+			Date:    sorted[i].Date(),
+			Bytes:   sorted[i].SizeEstimate,
+		})
+	}
+
+	return report
+}
+
+// Sender domains shared by people, trashing their old mail would trash personal mail
+var personalMailDomains = map[string]bool{
+	"gmail.com":      true,
+	"googlemail.com": true,
+	"outlook.com":    true,
+	"hotmail.com":    true,
+	"live.com":       true,
+	"msn.com":        true,
+	"yahoo.com":      true,
+	"ymail.com":      true,
+	"icloud.com":     true,
+	"me.com":         true,
+	"mac.com":        true,
+	"aol.com":        true,
+	"proton.me":      true,
+	"protonmail.com": true,
+	"gmx.com":        true,
+	"gmx.net":        true,
+	"mail.com":       true,
+	"yandex.com":     true,
+	"zoho.com":       true,
+	"fastmail.com":   true,
+}
+
+// StorageMigrations proposes trashing the largest messages and the mail older than a
+// year from the heaviest sender domains. The largest messages are listed by id, the
+// old mail is selected by a search run by the migration, within the labels and query
+// of the report. Personal mail domains and the domain of the account are left out.
+func StorageMigrations(report CadStorageReport, messages []*CadMessageMeta, labelIds []string, query string, accountAddress string, domains int) []CadRawMigration {
+	migrations := []CadRawMigration{}
+	trash := func(details CadMessagesMigration, note string) {
+		operation := TrashMessagesMigration
+		migrations = append(migrations, CadRawMigration{
+			Operation: &operation,
+			Details:   details,
+			Note:      &note,
+		})
+	}
+
+	largestIds := []string{}
+	largestBytes := int64(0)
+	for _, message := range report.Largest {
+		largestIds = append(largestIds, message.Id)
+		largestBytes += message.Bytes
+	}
+	if len(largestIds) > 0 {
+		trash(
+			CadMessagesMigration{MessageIds: &largestIds},
+			fmt.Sprintf("Trash the %d largest messages (%s)", len(largestIds), FormatBytes(largestBytes)),
+		)
+	}
+
+	accountDomain := strings.ToLower(accountAddress[strings.LastIndex(accountAddress, "@")+1:])
+	yearAgo := time.Now().AddDate(-1, 0, 0)
+	proposed := 0
+	for _, bucket := range report.ByDomain {
+		if proposed >= domains {
+			break
+		}
+		domain := bucket.Name
+		if domain == "(unknown)" || domain == accountDomain || personalMailDomains[domain] {
+			continue
+		}
+
+		count := 0
+		bytes := int64(0)
+		for _, meta := range messages {
+			if messageSenderDomain(meta) == domain && meta.Date().Before(yearAgo) {
+				count++
+				bytes += meta.SizeEstimate
+			}
+		}
+		if count == 0 {
+			continue
+		}
+		proposed++
+
+		domainQuery := fmt.Sprintf("from:(@%s) older_than:1y", domain)
+		if query != "" {
+			domainQuery = fmt.Sprintf("(%s) %s", query, domainQuery)
+		}
+		details := CadMessagesMigration{QueryString: &domainQuery}
+		if len(labelIds) > 0 {
+			queryLabelIds := labelIds
+			details.QueryLabelIds = &queryLabelIds
+		}
+		trash(details, fmt.Sprintf("Trash the mail older than a year from %s, %d messages (%s) when reported", domain, count, FormatBytes(bytes)))
+	}
+
+	return migrations
+}
+
+func sortedStorageBuckets(buckets map[string]*CadStorageBucket) []CadStorageBucket {
+	sorted := []CadStorageBucket{}
+	for _, bucket := range buckets {
+		sorted = append(sorted, *bucket)
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Bytes != sorted[j].Bytes {
+			return sorted[i].Bytes > sorted[j].Bytes
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted
+}
+
+// FormatBytes formats a size with a binary unit, eg 1.5 MiB
+func FormatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestStorageMigrations(t *testing.T) {
+	old := time.Now().AddDate(-2, 0, 0).UnixNano() / int64(time.Millisecond)
+	messages := []*CadMessageMeta{}
+	for i, from := range []string{
+		"friend@gmail.com",
+		"friend@gmail.com",
+		"colleague@me.example",
+		"colleague@me.example",
+		"news@shop.example",
+		"deals@shop.example",
+		"alerts@bank.example",
+	} {
+		messages = append(messages, &CadMessageMeta{
+			Id:           fmt.Sprintf("m%d", i),
+			InternalDate: old,
+			SizeEstimate: 1000,
+			Headers:      map[string]string{"From": from},
+		})
+	}
+	report := StorageReport(messages, map[string]string{}, 1)
+
+	migrations := StorageMigrations(report, messages, []string{"Label_1"}, "has:attachment", "me@me.example", 1)
+	if len(migrations) != 2 {
+		t.Fatalf("StorageMigrations() = %d migrations, want the largest messages and one domain", len(migrations))
+	}
+
+	largest := migrations[0].Details.(CadMessagesMigration)
+	if largest.MessageIds == nil || len(*largest.MessageIds) != 1 {
+		t.Errorf("largest messages migration = %+v, want one message id", largest)
+	}
+
+	domain := migrations[1].Details.(CadMessagesMigration)
+	if domain.MessageIds != nil {
+		t.Errorf("domain migration lists message ids %v, want a query", *domain.MessageIds)
+	}
+	if want := "(has:attachment) from:(@shop.example) older_than:1y"; domain.QueryString == nil || *domain.QueryString != want {
+		t.Errorf("domain migration query = %v, want %q", domain.QueryString, want)
+	}
+	if domain.QueryLabelIds == nil || len(*domain.QueryLabelIds) != 1 || (*domain.QueryLabelIds)[0] != "Label_1" {
+		t.Errorf("domain migration labels = %v, want Label_1", domain.QueryLabelIds)
+	}
+}
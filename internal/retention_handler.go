@@ -0,0 +1,187 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+)
+
+const RetentionArchive string = "archive"
+const RetentionMarkRead string = "mark-read"
+const RetentionRelabel string = "relabel"
+const RetentionTrash string = "trash"
+
+// CadRetentionPolicy applies an action to the messages with a label once they are older
+// than the given number of days. Relabel moves them to the RelabelTo label.
+type CadRetentionPolicy struct {
+	Label          string `json:"label"`
+	OlderThanDays  int    `json:"olderThanDays"`
+	Action         string `json:"action"`
+	RelabelTo      string `json:"relabelTo,omitempty"`
+	ExcludeStarred bool   `json:"excludeStarred,omitempty"`
+}
+
+// CadRetentionPreview is the number of messages a policy would affect today
+type CadRetentionPreview struct {
+	Policy   CadRetentionPolicy `json:"policy"`
+	Query    string             `json:"query"`
+	Messages int                `json:"messages"`
+}
+
+func (policy CadRetentionPolicy) String() string {
+	description := fmt.Sprintf("%s %s older than %dd", policy.Action, policy.Label, policy.OlderThanDays)
+	if policy.Action == RetentionRelabel {
+		description += " to " + policy.RelabelTo
+	}
+	if policy.ExcludeStarred {
+		description += " except starred"
+	}
+	return description
+}
+
+// Query returns the search query selecting the messages of the policy label the
+// policy still has to act on
+func (policy CadRetentionPolicy) Query() string {
+	terms := []string{fmt.Sprintf("older_than:%dd", policy.OlderThanDays)}
+	switch policy.Action {
+	case RetentionArchive:
+		terms = append(terms, "in:inbox")
+	case RetentionMarkRead:
+		terms = append(terms, "is:unread")
+	}
+	if policy.ExcludeStarred {
+		terms = append(terms, "-is:starred")
+	}
+	return strings.Join(terms, " ")
+}
+
+// RetentionMigrations compiles the retention policies into migrations, using the
+// labels to resolve the label names of the policies
+func RetentionMigrations(policies []CadRetentionPolicy, labels []*CadLabel) ([]CadRawMigration, error) {
+	migrations := []CadRawMigration{}
+	for _, policy := range policies {
+		if policy.OlderThanDays <= 0 {
+			return nil, fmt.Errorf("retention policy %q: olderThanDays must be positive", policy)
+		}
+		label := findLabelByName(labels, policy.Label)
+		if label == nil {
+			return nil, fmt.Errorf("retention policy %q: unknown label %s", policy, policy.Label)
+		}
+		query := policy.Query()
+		queryLabelIds := []string{label.Id}
+
+		var operation string
+		var details interface{}
+		switch policy.Action {
+		case RetentionArchive:
+			operation = UpdateMessagesMigration
+			details = CadUpdateMessagesMigration{
+				QueryLabelIds:  &queryLabelIds,
+				QueryString:    &query,
+				AddLabelIds:    &[]string{},
+				RemoveLabelIds: &[]string{"INBOX"},
+			}
+		case RetentionMarkRead:
+			operation = UpdateMessagesMigration
+			details = CadUpdateMessagesMigration{
+				QueryLabelIds:  &queryLabelIds,
+				QueryString:    &query,
+				AddLabelIds:    &[]string{},
+				RemoveLabelIds: &[]string{"UNREAD"},
+			}
+		case RetentionRelabel:
+			target := findLabelByName(labels, policy.RelabelTo)
+			if target == nil {
+				return nil, fmt.Errorf("retention policy %q: unknown label %s to relabel to", policy, policy.RelabelTo)
+			}
+			operation = UpdateMessagesMigration
+			details = CadUpdateMessagesMigration{
+				QueryLabelIds:  &queryLabelIds,
+				QueryString:    &query,
+				AddLabelIds:    &[]string{target.Id},
+				RemoveLabelIds: &[]string{label.Id},
+			}
+		case RetentionTrash:
+			operation = TrashMessagesMigration
+			details = CadMessagesMigration{
+				QueryLabelIds: &queryLabelIds,
+				QueryString:   &query,
+			}
+		default:
+			return nil, fmt.Errorf("retention policy %q: unknown action %s, use archive, mark-read, relabel or trash", policy, policy.Action)
+		}
+
+		rawDetails, err := json.Marshal(details)
+		if err != nil {
+			log.Printf("Unable to marshal retention migration: %v", err)
+			return nil, err
+		}
+		note := "Retention: " + policy.String()
+		migrations = append(migrations, CadRawMigration{
+			Operation:  &operation,
+			Details:    details,
+			RawDetails: rawDetails,
+			Note:       &note,
+		})
+	}
+
+	return migrations, nil
+}
+
+// RunRetentionPolicies applies the retention policies of the config
+func RunRetentionPolicies(policies []CadRetentionPolicy) error {
+	labels, err := GetLabels()
+	if err != nil {
+		log.Printf("Unable to retrieve labels: %v", err)
+		return err
+	}
+
+	migrations, err := RetentionMigrations(policies, labels)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Applying %d retention policies\n", len(migrations))
+	for _, migration := range migrations {
+		fmt.Printf("%s\n", *migration.Note)
+		if err := runMigration(migration); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PreviewRetentionPolicies counts the messages each retention policy would act on today
+func PreviewRetentionPolicies(policies []CadRetentionPolicy) ([]CadRetentionPreview, error) {
+	labels, err := GetLabels()
+	if err != nil {
+		log.Printf("Unable to retrieve labels: %v", err)
+		return nil, err
+	}
+
+	// Compiling the policies validates them
+	if _, err := RetentionMigrations(policies, labels); err != nil {
+		return nil, err
+	}
+
+	previews := []CadRetentionPreview{}
+	for _, policy := range policies {
+		query := policy.Query()
+		ids, err := GetMessagesIDsByLabelIDs([]*CadLabel{findLabelByName(labels, policy.Label)}, &query)
+		if err != nil {
+			return nil, err
+		}
+		previews = append(previews, CadRetentionPreview{Policy: policy, Query: query, Messages: len(ids)})
+	}
+	return previews, nil
+}
+
+func findLabelByName(labels []*CadLabel, name string) *CadLabel {
+	for _, label := range labels {
+		if strings.EqualFold(label.Name, name) {
+			return label
+		}
+	}
+	return nil
+}
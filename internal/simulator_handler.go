@@ -0,0 +1,364 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// CadMessageFacts holds the parts of a message that filter criteria are evaluated against
+type CadMessageFacts struct {
+	Id            string   `json:"id,omitempty"`
+	From          string   `json:"from,omitempty"`
+	To            string   `json:"to,omitempty"`
+	Cc            string   `json:"cc,omitempty"`
+	Bcc           string   `json:"bcc,omitempty"`
+	DeliveredTo   string   `json:"deliveredTo,omitempty"`
+	Subject       string   `json:"subject,omitempty"`
+	ListId        string   `json:"listId,omitempty"`
+	Body          string   `json:"body,omitempty"`
+	Filenames     []string `json:"filenames,omitempty"`
+	HasAttachment bool     `json:"hasAttachment,omitempty"`
+	Size          int64    `json:"size,omitempty"`
+	LabelIds      []string `json:"labelIds,omitempty"`
+	LabelNames    []string `json:"labelNames,omitempty"`
+}
+
+type CadLabelChanges struct {
+	AddLabelIds    []string `json:"addLabelIds,omitempty"`
+	RemoveLabelIds []string `json:"removeLabelIds,omitempty"`
+	Forwards       []string `json:"forwards,omitempty"`
+}
+
+// ReadMessageFacts loads a message either from a local .eml file or, failing
+// that, from Gmail using the argument as a message ID
+func ReadMessageFacts(source string) (*CadMessageFacts, error) {
+	if fileExists(source) {
+		return ReadMessageFactsFromFile(source)
+	}
+
+	srv, err := GetService()
+	if err != nil {
+		log.Printf("Unable to retrieve Gmail client: %v", err)
+		return nil, err
+	}
+
+	user := "me"
+	message, err := srv.Users.Messages.Get(user, source).Format("full").Do()
+	if err != nil {
+		log.Printf("Unable to retrieve message: %s %v", source, err)
+		return nil, err
+	}
+
+	facts := MarshalMessageFacts(message)
+	content, err := ReadMessageContent(srv, message, false)
+	if err != nil {
+		log.Printf("Unable to read message body: %v", err)
+		return nil, err
+	}
+	facts.Body = content.Body()
+
+	return facts, nil
+}
+
+func ReadMessageFactsFromFile(filename string) (*CadMessageFacts, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		log.Printf("Unable to read message file: %v", err)
+		return nil, err
+	}
+
+	message, err := mail.ReadMessage(bytes.NewReader(b))
+	if err != nil {
+		log.Printf("Unable to parse message file: %v", err)
+		return nil, err
+	}
+
+	facts := &CadMessageFacts{
+		Id:          filename,
+		From:        message.Header.Get("From"),
+		To:          message.Header.Get("To"),
+		Cc:          message.Header.Get("Cc"),
+		Bcc:         message.Header.Get("Bcc"),
+		DeliveredTo: message.Header.Get("Delivered-To"),
+		ListId:      message.Header.Get("List-Id"),
+		Size:        int64(len(b)),
+	}
+
+	decoder := new(mime.WordDecoder)
+	subject := message.Header.Get("Subject")
+	if decoded, err := decoder.DecodeHeader(subject); err == nil {
+		subject = decoded
+	}
+	facts.Subject = subject
+
+	content, err := ReadRawMessageContent(message)
+	if err != nil {
+		log.Printf("Unable to read message body: %v", err)
+		return nil, err
+	}
+	content.addFacts(facts)
+
+	return facts, nil
+}
+
+func (content *CadMessageContent) addFacts(facts *CadMessageFacts) {
+	facts.Body = content.Body()
+	for _, attachment := range content.Attachments {
+		facts.HasAttachment = true
+		facts.Filenames = append(facts.Filenames, attachment.Filename)
+	}
+}
+
+func MarshalMessageFacts(message *gmail.Message) *CadMessageFacts {
+	facts := &CadMessageFacts{
+		Id:       message.Id,
+		Body:     message.Snippet,
+		Size:     message.SizeEstimate,
+		LabelIds: message.LabelIds,
+	}
+
+	if message.Payload == nil {
+		return facts
+	}
+
+	for _, header := range message.Payload.Headers {
+		switch strings.ToLower(header.Name) {
+		case "from":
+			facts.From = header.Value
+		case "to":
+			facts.To = header.Value
+		case "cc":
+			facts.Cc = header.Value
+		case "bcc":
+			facts.Bcc = header.Value
+		case "delivered-to":
+			facts.DeliveredTo = header.Value
+		case "subject":
+			facts.Subject = header.Value
+		case "list-id":
+			facts.ListId = header.Value
+		}
+	}
+
+	parts := []*gmail.MessagePart{message.Payload}
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = append(parts[1:], part.Parts...)
+		if part.Filename != "" {
+			facts.HasAttachment = true
+			facts.Filenames = append(facts.Filenames, part.Filename)
+		}
+	}
+
+	return facts
+}
+
+// MatchCriteria reports whether a message satisfies the criteria, evaluating
+// the same search query Gmail would run for the filter
+func MatchCriteria(criteria CadCriteria, facts *CadMessageFacts) (bool, error) {
+	node, err := ParseQuery(CriteriaQuery(criteria))
+	if err != nil {
+		return false, err
+	}
+
+	return node.Match(facts), nil
+}
+
+// FiltersMatchingMessage returns the local filters that would apply to the message
+func FiltersMatchingMessage(facts *CadMessageFacts) ([]CadFilter, error) {
+	filters, err := ReadLocalFilters()
+	if err != nil {
+		log.Printf("Unable to read local filters file: %v", err)
+		return nil, err
+	}
+
+	// label: criteria use label names, the message only has label ids
+	labels, err := ReadLocalLabels()
+	if err != nil {
+		log.Printf("Unable to read local labels: %v", err)
+		return nil, err
+	}
+	facts.addLabelNames(labels)
+
+	matches := []CadFilter{}
+	for _, filter := range filters {
+		if filter.Criteria == nil {
+			continue
+		}
+		ok, err := MatchCriteria(*filter.Criteria, facts)
+		if err != nil {
+			log.Printf("Unable to evaluate filter %s: %v", filter.Id, err)
+			continue
+		}
+		if ok {
+			matches = append(matches, filter)
+		}
+	}
+
+	return matches, nil
+}
+
+// CombinedLabelChanges merges the actions of several filters into the net
+// change applied to a message
+func CombinedLabelChanges(filters []CadFilter) CadLabelChanges {
+	added := map[string]bool{}
+	removed := map[string]bool{}
+	forwards := map[string]bool{}
+
+	for _, filter := range filters {
+		if filter.Action == nil {
+			continue
+		}
+		for _, labelId := range filter.Action.AddLabelIds {
+			added[labelId] = true
+		}
+		for _, labelId := range filter.Action.RemoveLabelIds {
+			removed[labelId] = true
+		}
+		if filter.Action.Forward != "" {
+			forwards[filter.Action.Forward] = true
+		}
+	}
+
+	changes := CadLabelChanges{
+		AddLabelIds:    sortedKeys(added),
+		RemoveLabelIds: sortedKeys(removed),
+		Forwards:       sortedKeys(forwards),
+	}
+	return changes
+}
+
+// Match evaluates the query tree against a message
+func (node *CadQueryNode) Match(facts *CadMessageFacts) bool {
+	switch node.Kind {
+	case QueryAnd:
+		for _, child := range node.Children {
+			if !child.Match(facts) {
+				return false
+			}
+		}
+		return true
+	case QueryOr:
+		for _, child := range node.Children {
+			if child.Match(facts) {
+				return true
+			}
+		}
+		return false
+	case QueryNot:
+		return !node.Children[0].Match(facts)
+	default:
+		return node.matchTerm(facts)
+	}
+}
+
+func (node *CadQueryNode) matchTerm(facts *CadMessageFacts) bool {
+	value := strings.ToLower(node.Value)
+
+	switch node.Operator {
+	case "":
+		return containsFold(value, facts.From, facts.To, facts.Cc, facts.Subject, facts.Body)
+	case "from":
+		return containsFold(value, facts.From)
+	case "to":
+		return containsFold(value, facts.To, facts.Cc, facts.Bcc, facts.DeliveredTo)
+	case "cc":
+		return containsFold(value, facts.Cc)
+	case "bcc":
+		return containsFold(value, facts.Bcc)
+	case "deliveredto":
+		return containsFold(value, facts.DeliveredTo)
+	case "subject":
+		return containsFold(value, facts.Subject)
+	case "list":
+		return containsFold(value, facts.ListId)
+	case "filename":
+		return containsFold(value, facts.Filenames...)
+	case "has":
+		return value == "attachment" && facts.HasAttachment
+	case "label", "in", "is":
+		for _, labelId := range facts.LabelIds {
+			if strings.EqualFold(labelId, value) {
+				return true
+			}
+		}
+		for _, name := range facts.LabelNames {
+			if labelQueryName(name) == labelQueryName(value) {
+				return true
+			}
+		}
+		return false
+	case "larger", "size":
+		size, err := parseQuerySize(value)
+		return err == nil && facts.Size > size
+	case "smaller":
+		size, err := parseQuerySize(value)
+		return err == nil && facts.Size < size
+	}
+
+	return false
+}
+
+// addLabelNames sets the names of the labels of the message from their ids
+func (facts *CadMessageFacts) addLabelNames(labels []CadLabel) {
+	names := map[string]string{}
+	for _, label := range labels {
+		names[label.Id] = label.Name
+	}
+	facts.LabelNames = []string{}
+	for _, labelId := range facts.LabelIds {
+		if name, ok := names[labelId]; ok {
+			facts.LabelNames = append(facts.LabelNames, name)
+		}
+	}
+}
+
+// labelQueryName returns a label name as written in a search, Gmail matches label:my-list
+// for a label named "My List" or "My/List"
+func labelQueryName(name string) string {
+	return strings.NewReplacer(" ", "-", "/", "-").Replace(strings.ToLower(name))
+}
+
+func containsFold(value string, fields ...string) bool {
+	for _, field := range fields {
+		if strings.Contains(strings.ToLower(field), value) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseQuerySize(value string) (int64, error) {
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(value, "k"):
+		multiplier = 1024
+	case strings.HasSuffix(value, "m"):
+		multiplier = 1024 * 1024
+	}
+	value = strings.TrimRight(value, "km")
+
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %s", value)
+	}
+	return size * multiplier, nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,42 @@
+package internal
+
+import "testing"
+
+func TestMatchCriteriaLabels(t *testing.T) {
+	labels := []CadLabel{
+		{Id: "INBOX", Name: "INBOX", Type: "system"},
+		{Id: "UNREAD", Name: "UNREAD", Type: "system"},
+		{Id: "Label_123", Name: "Receipts", Type: user},
+		{Id: "Label_456", Name: "Work/Big Project", Type: user},
+	}
+	facts := &CadMessageFacts{LabelIds: []string{"INBOX", "UNREAD", "Label_123", "Label_456"}}
+	facts.addLabelNames(labels)
+
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{query: "label:Receipts", want: true},
+		{query: "label:receipts", want: true},
+		{query: "label:Label_123", want: true},
+		{query: "label:work-big-project", want: true},
+		{query: `label:"Work/Big Project"`, want: true},
+		{query: "label:Invoices", want: false},
+		{query: "in:inbox", want: true},
+		{query: "is:unread", want: true},
+		{query: "is:starred", want: false},
+		{query: "-label:Receipts", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			got, err := MatchCriteria(CadCriteria{Query: tt.query}, facts)
+			if err != nil {
+				t.Fatalf("MatchCriteria() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("MatchCriteria(%q) = %v, want %v", tt.query, got, tt.want)
+			}
+		})
+	}
+}
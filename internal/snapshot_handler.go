@@ -0,0 +1,319 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const snapshotsPath string = "data/snapshots"
+const lastMigrateSnapshotFile string = "data/snapshots/last-migrate"
+const snapshotNameLayout string = "20060102-150405.000"
+
+const LatestSnapshot string = "latest"
+const LiveSnapshot string = "live"
+
+// CadAccountState is the configuration of the account at a point in time
+type CadAccountState struct {
+	Name    string      `json:"name"`
+	Labels  []CadLabel  `json:"labels"`
+	Filters []CadFilter `json:"filters"`
+}
+
+type CadLabelChange struct {
+	Label   CadLabel `json:"label"`
+	Changes []string `json:"changes"`
+}
+
+type CadFilterChange struct {
+	From CadFilter `json:"from"`
+	To   CadFilter `json:"to"`
+}
+
+type CadAccountDiff struct {
+	AddedLabels    []CadLabel        `json:"addedLabels,omitempty"`
+	RemovedLabels  []CadLabel        `json:"removedLabels,omitempty"`
+	ChangedLabels  []CadLabelChange  `json:"changedLabels,omitempty"`
+	AddedFilters   []CadFilter       `json:"addedFilters,omitempty"`
+	RemovedFilters []CadFilter       `json:"removedFilters,omitempty"`
+	ChangedFilters []CadFilterChange `json:"changedFilters,omitempty"`
+}
+
+// TakeSnapshot copies the local labels and filters into a timestamped snapshot and
+// prunes the oldest snapshots beyond the configured retention. Snapshots taken
+// after a migration are remembered so later web UI changes can be found.
+func TakeSnapshot(afterMigrate bool) (string, error) {
+	if err := os.MkdirAll(snapshotsPath, 0775); err != nil {
+		log.Printf("Unable to create snapshots directory: %v", err)
+		return "", err
+	}
+	// Names have millisecond precision, a snapshot taken in the same millisecond as
+	// another waits for the next one rather than overwriting it
+	var name, dir string
+	for {
+		name = time.Now().Format(snapshotNameLayout)
+		dir = filepath.Join(snapshotsPath, name)
+		err := os.Mkdir(dir, 0775)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			log.Printf("Unable to create snapshot directory: %v", err)
+			return "", err
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	for _, datafile := range []string{labeldatafile, filterdatafile} {
+		if !fileExists(datafile) {
+			continue
+		}
+		b, err := ioutil.ReadFile(datafile)
+		if err != nil {
+			log.Printf("Unable to read %s: %v", datafile, err)
+			return "", err
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, filepath.Base(datafile)), b, 0664)
+		if err != nil {
+			log.Printf("Unable to persist snapshot: %v", err)
+			return "", err
+		}
+	}
+
+	if afterMigrate {
+		if err := ioutil.WriteFile(lastMigrateSnapshotFile, []byte(name), 0664); err != nil {
+			log.Printf("Unable to persist last migrate snapshot: %v", err)
+			return "", err
+		}
+	}
+
+	config, err := ReadConfig()
+	if err != nil {
+		return "", err
+	}
+	if err := pruneSnapshots(config.Snapshots.Retention); err != nil {
+		return "", err
+	}
+
+	return name, nil
+}
+
+// ListSnapshots returns the snapshot names from oldest to newest
+func ListSnapshots() ([]string, error) {
+	if _, err := os.Stat(snapshotsPath); os.IsNotExist(err) {
+		return []string{}, nil
+	}
+
+	entries, err := os.ReadDir(snapshotsPath)
+	if err != nil {
+		log.Printf("Unable to read the snapshots directory: %v", err)
+		return nil, err
+	}
+
+	// Snapshots taken before names had milliseconds have no fraction
+	r := regexp.MustCompile(`^[0-9]{8}-[0-9]{6}(\.[0-9]{3})?$`)
+	names := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() && r.MatchString(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// LastMigrateSnapshot returns the snapshot taken after the last migrate run
+func LastMigrateSnapshot() (string, error) {
+	if !fileExists(lastMigrateSnapshotFile) {
+		return "", errors.New("no snapshot has been taken after a migration")
+	}
+
+	b, err := ioutil.ReadFile(lastMigrateSnapshotFile)
+	if err != nil {
+		log.Printf("Unable to read last migrate snapshot: %v", err)
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// LoadAccountState loads a snapshot by name, the latest snapshot or the live account
+func LoadAccountState(name string) (*CadAccountState, error) {
+	switch name {
+	case LiveSnapshot:
+		labels, err := GetLabels()
+		if err != nil {
+			return nil, err
+		}
+		filters, err := GetFilters()
+		if err != nil {
+			return nil, err
+		}
+
+		state := &CadAccountState{Name: LiveSnapshot}
+		for _, label := range labels {
+			state.Labels = append(state.Labels, *label)
+		}
+		for _, filter := range filters {
+			state.Filters = append(state.Filters, *filter)
+		}
+		return state, nil
+	case LatestSnapshot:
+		names, err := ListSnapshots()
+		if err != nil {
+			return nil, err
+		}
+		if len(names) == 0 {
+			return nil, errors.New("no snapshots found, run fetch first")
+		}
+		name = names[len(names)-1]
+	}
+
+	dir := filepath.Join(snapshotsPath, name)
+	if _, err := os.Stat(dir); err != nil {
+		return nil, fmt.Errorf("unknown snapshot %s", name)
+	}
+
+	state := &CadAccountState{Name: name}
+	if err := readSnapshotFile(filepath.Join(dir, filepath.Base(labeldatafile)), &state.Labels); err != nil {
+		return nil, err
+	}
+	if err := readSnapshotFile(filepath.Join(dir, filepath.Base(filterdatafile)), &state.Filters); err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// DiffAccountStates compares labels by ID and filters by ID, treating a filter
+// recreated with the same criteria as a changed filter
+func DiffAccountStates(from *CadAccountState, to *CadAccountState) CadAccountDiff {
+	diff := CadAccountDiff{}
+
+	fromLabels := map[string]CadLabel{}
+	for _, label := range from.Labels {
+		fromLabels[label.Id] = label
+	}
+	toLabels := map[string]bool{}
+	for _, label := range to.Labels {
+		toLabels[label.Id] = true
+		old, ok := fromLabels[label.Id]
+		if !ok {
+			diff.AddedLabels = append(diff.AddedLabels, label)
+			continue
+		}
+		if changes := labelChanges(old, label); len(changes) > 0 {
+			diff.ChangedLabels = append(diff.ChangedLabels, CadLabelChange{Label: label, Changes: changes})
+		}
+	}
+	for _, label := range from.Labels {
+		if !toLabels[label.Id] {
+			diff.RemovedLabels = append(diff.RemovedLabels, label)
+		}
+	}
+
+	fromFilters := map[string]bool{}
+	for _, filter := range from.Filters {
+		fromFilters[filter.Id] = true
+	}
+	toFilters := map[string]bool{}
+	added := map[string][]CadFilter{}
+	for _, filter := range to.Filters {
+		toFilters[filter.Id] = true
+		if !fromFilters[filter.Id] {
+			key := CriteriaKey(*filter.Criteria)
+			added[key] = append(added[key], filter)
+		}
+	}
+	for _, filter := range from.Filters {
+		if toFilters[filter.Id] {
+			continue
+		}
+		key := CriteriaKey(*filter.Criteria)
+		if len(added[key]) > 0 {
+			diff.ChangedFilters = append(diff.ChangedFilters, CadFilterChange{From: filter, To: added[key][0]})
+			added[key] = added[key][1:]
+		} else {
+			diff.RemovedFilters = append(diff.RemovedFilters, filter)
+		}
+	}
+	for _, filter := range to.Filters {
+		if fromFilters[filter.Id] {
+			continue
+		}
+		key := CriteriaKey(*filter.Criteria)
+		for _, remaining := range added[key] {
+			if remaining.Id == filter.Id {
+				diff.AddedFilters = append(diff.AddedFilters, filter)
+				break
+			}
+		}
+	}
+
+	return diff
+}
+
+func labelChanges(from CadLabel, to CadLabel) []string {
+	changes := []string{}
+	if from.Name != to.Name {
+		changes = append(changes, fmt.Sprintf("name %s -> %s", from.Name, to.Name))
+	}
+	if from.LabelListVisibility != to.LabelListVisibility {
+		changes = append(changes, fmt.Sprintf("labelListVisibility %s -> %s", from.LabelListVisibility, to.LabelListVisibility))
+	}
+	if from.MessageListVisibility != to.MessageListVisibility {
+		changes = append(changes, fmt.Sprintf("messageListVisibility %s -> %s", from.MessageListVisibility, to.MessageListVisibility))
+	}
+	if from.Color != to.Color {
+		changes = append(changes, fmt.Sprintf("color %s/%s -> %s/%s",
+			from.Color.BackgroundColor, from.Color.TextColor,
+			to.Color.BackgroundColor, to.Color.TextColor))
+	}
+	return changes
+}
+
+func pruneSnapshots(retention int) error {
+	if retention < 0 {
+		return nil
+	}
+
+	names, err := ListSnapshots()
+	if err != nil {
+		return err
+	}
+
+	// The snapshot taken after the last migration is kept for diff --since-last-migrate
+	lastMigrate, _ := LastMigrateSnapshot()
+	for i := 0; len(names)-i > retention; i++ {
+		if names[i] == lastMigrate {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(snapshotsPath, names[i])); err != nil {
+			log.Printf("Unable to remove snapshot %s: %v", names[i], err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+func readSnapshotFile(filename string, v interface{}) error {
+	if !fileExists(filename) {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		log.Printf("Unable to read snapshot file %s: %v", filename, err)
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffAccountStates(t *testing.T) {
+	newsFilter := func(id string, labelId string) CadFilter {
+		return CadFilter{Id: id, Criteria: &CadCriteria{From: "news@x.com"}, Action: &CadAction{AddLabelIds: []string{labelId}}}
+	}
+	from := &CadAccountState{
+		Labels: []CadLabel{
+			{Id: "Label_1", Name: "News", Type: user},
+			{Id: "Label_2", Name: "Old", Type: user},
+			{Id: "Label_3", Name: "Receipts", Type: user, Color: CadLabelColor{BackgroundColor: "#000000", TextColor: "#ffffff"}},
+		},
+		Filters: []CadFilter{
+			newsFilter("f1", "Label_1"),
+			{Id: "f2", Criteria: &CadCriteria{From: "old@x.com"}, Action: &CadAction{AddLabelIds: []string{"Label_2"}}},
+			{Id: "f3", Criteria: &CadCriteria{Subject: "receipt"}, Action: &CadAction{AddLabelIds: []string{"Label_3"}}},
+		},
+	}
+	to := &CadAccountState{
+		Labels: []CadLabel{
+			{Id: "Label_1", Name: "Newsletters", Type: user},
+			{Id: "Label_3", Name: "Receipts", Type: user, Color: CadLabelColor{BackgroundColor: "#000000", TextColor: "#ffffff"}},
+			{Id: "Label_4", Name: "Invoices", Type: user},
+		},
+		Filters: []CadFilter{
+			// Gmail filters cannot be edited, so a replaced filter comes back with a new id
+			newsFilter("f4", "Label_4"),
+			// Both filters match the same criteria, only one of them replaces f1
+			newsFilter("f5", "Label_1"),
+			{Id: "f3", Criteria: &CadCriteria{Subject: "receipt"}, Action: &CadAction{AddLabelIds: []string{"Label_3"}}},
+		},
+	}
+
+	diff := DiffAccountStates(from, to)
+
+	want := CadAccountDiff{
+		AddedLabels:    []CadLabel{to.Labels[2]},
+		RemovedLabels:  []CadLabel{from.Labels[1]},
+		ChangedLabels:  []CadLabelChange{{Label: to.Labels[0], Changes: []string{"name News -> Newsletters"}}},
+		AddedFilters:   []CadFilter{to.Filters[1]},
+		RemovedFilters: []CadFilter{from.Filters[1]},
+		ChangedFilters: []CadFilterChange{{From: from.Filters[0], To: to.Filters[0]}},
+	}
+	if !reflect.DeepEqual(diff, want) {
+		t.Errorf("DiffAccountStates() = %+v, want %+v", diff, want)
+	}
+
+	if diff := DiffAccountStates(from, from); !reflect.DeepEqual(diff, CadAccountDiff{}) {
+		t.Errorf("DiffAccountStates() of a state with itself = %+v, want no changes", diff)
+	}
+}
+
+func TestLabelChanges(t *testing.T) {
+	tests := []struct {
+		name string
+		from CadLabel
+		to   CadLabel
+		want []string
+	}{
+		{name: "unchanged", from: CadLabel{Name: "A"}, to: CadLabel{Name: "A"}, want: []string{}},
+		{
+			name: "visibility",
+			from: CadLabel{Name: "A", LabelListVisibility: "labelShow", MessageListVisibility: "show"},
+			to:   CadLabel{Name: "A", LabelListVisibility: "labelHide", MessageListVisibility: "hide"},
+			want: []string{"labelListVisibility labelShow -> labelHide", "messageListVisibility show -> hide"},
+		},
+		{
+			name: "color",
+			from: CadLabel{Name: "A"},
+			to:   CadLabel{Name: "A", Color: CadLabelColor{BackgroundColor: "#000000", TextColor: "#ffffff"}},
+			want: []string{"color / -> #000000/#ffffff"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := labelChanges(tt.from, tt.to); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("labelChanges() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
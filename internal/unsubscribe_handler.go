@@ -0,0 +1,276 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+const unsubscribedatafile string = "data/unsubscribes.json"
+
+const UnsubscribeOneClick string = "one-click"
+const UnsubscribeMailto string = "mailto"
+
+// The List-Unsubscribe-Post value required by RFC 8058 for one-click unsubscribes
+const oneClickPostBody string = "List-Unsubscribe=One-Click"
+
+// CadListUnsubscribe holds the targets of an RFC 2369 List-Unsubscribe header.
+// OneClick is set when the RFC 8058 List-Unsubscribe-Post header allows a one-click POST.
+type CadListUnsubscribe struct {
+	HTTPS    []string `json:"https,omitempty"`
+	Mailto   []string `json:"mailto,omitempty"`
+	Other    []string `json:"other,omitempty"`
+	OneClick bool     `json:"oneClick,omitempty"`
+}
+
+type CadUnsubscribeRecord struct {
+	Sender string    `json:"sender"`
+	Method string    `json:"method"`
+	Target string    `json:"target"`
+	Status string    `json:"status"`
+	At     time.Time `json:"at"`
+}
+
+// CadUnsubscriber performs unsubscribes. The HTTP client and the send function can be
+// replaced, eg with an httptest server client. In dry-run mode nothing is sent or logged.
+type CadUnsubscriber struct {
+	Client  *http.Client
+	Send    func(raw []byte) error
+	DryRun  bool
+	LogFile string
+}
+
+// ParseListUnsubscribe parses the List-Unsubscribe and List-Unsubscribe-Post header values
+func ParseListUnsubscribe(listUnsubscribe string, listUnsubscribePost string) CadListUnsubscribe {
+	regTarget := regexp.MustCompile(`<([^>]*)>`)
+
+	unsubscribe := CadListUnsubscribe{}
+	for _, parts := range regTarget.FindAllStringSubmatch(listUnsubscribe, -1) {
+		target := strings.TrimSpace(parts[1])
+		switch {
+		case strings.HasPrefix(strings.ToLower(target), "https:"):
+			unsubscribe.HTTPS = append(unsubscribe.HTTPS, target)
+		case strings.HasPrefix(strings.ToLower(target), "mailto:"):
+			unsubscribe.Mailto = append(unsubscribe.Mailto, target)
+		case target != "":
+			unsubscribe.Other = append(unsubscribe.Other, target)
+		}
+	}
+	unsubscribe.OneClick = len(unsubscribe.HTTPS) > 0 &&
+		strings.EqualFold(strings.TrimSpace(listUnsubscribePost), oneClickPostBody)
+
+	return unsubscribe
+}
+
+// ListUnsubscribeFromHeaders parses the unsubscribe headers of a message
+func ListUnsubscribeFromHeaders(headers []*gmail.MessagePartHeader) CadListUnsubscribe {
+	listUnsubscribe := ""
+	listUnsubscribePost := ""
+	for _, header := range headers {
+		switch strings.ToLower(header.Name) {
+		case "list-unsubscribe":
+			listUnsubscribe = header.Value
+		case "list-unsubscribe-post":
+			listUnsubscribePost = header.Value
+		}
+	}
+	return ParseListUnsubscribe(listUnsubscribe, listUnsubscribePost)
+}
+
+// Link returns the target a person would follow: the first https target, then the
+// first mailto target
+func (unsubscribe CadListUnsubscribe) Link() string {
+	for _, targets := range [][]string{unsubscribe.HTTPS, unsubscribe.Mailto, unsubscribe.Other} {
+		if len(targets) > 0 {
+			return targets[0]
+		}
+	}
+	return ""
+}
+
+// CanUnsubscribe reports whether the unsubscribe can be done without a browser
+func (unsubscribe CadListUnsubscribe) CanUnsubscribe() bool {
+	return unsubscribe.OneClick || len(unsubscribe.Mailto) > 0
+}
+
+func NewUnsubscriber(dryRun bool) *CadUnsubscriber {
+	return &CadUnsubscriber{
+		Client:  newUnsubscribeClient(),
+		Send:    SendMessage,
+		DryRun:  dryRun,
+		LogFile: unsubscribedatafile,
+	}
+}
+
+// Unsubscribe sends the one-click POST when the sender supports it, otherwise the
+// unsubscribe mail to the mailto target, and logs the result
+func (unsubscriber *CadUnsubscriber) Unsubscribe(sender string, unsubscribe CadListUnsubscribe) (*CadUnsubscribeRecord, error) {
+	record := &CadUnsubscribeRecord{Sender: sender, At: time.Now().UTC()}
+
+	switch {
+	case unsubscribe.OneClick:
+		record.Method = UnsubscribeOneClick
+		record.Target = unsubscribe.HTTPS[0]
+	case len(unsubscribe.Mailto) > 0:
+		record.Method = UnsubscribeMailto
+		record.Target = unsubscribe.Mailto[0]
+	default:
+		return nil, fmt.Errorf("no one-click or mailto unsubscribe for %s", sender)
+	}
+
+	if unsubscriber.DryRun {
+		record.Status = "dry-run"
+		fmt.Printf("Would unsubscribe from %s with %s %s\n", sender, record.Method, record.Target)
+		return record, nil
+	}
+
+	var err error
+	if record.Method == UnsubscribeOneClick {
+		err = unsubscriber.postOneClick(record.Target)
+	} else {
+		err = unsubscriber.sendMailto(record.Target)
+	}
+	if err != nil {
+		log.Printf("Unable to unsubscribe from %s: %v", sender, err)
+		// A refused one-click POST is logged, the sender may need a browser instead
+		if record.Method == UnsubscribeOneClick {
+			record.Status = "failed"
+			unsubscriber.appendLog(record)
+		}
+		return nil, err
+	}
+	record.Status = "sent"
+
+	if err := unsubscriber.appendLog(record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// newUnsubscribeClient returns a client which does not follow the redirect answering
+// the one-click POST, following it would turn the POST into a GET on a landing page
+func newUnsubscribeClient() *http.Client {
+	return &http.Client{
+		Timeout: 30 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if via[0].Method == http.MethodPost {
+				return http.ErrUseLastResponse
+			}
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return nil
+		},
+	}
+}
+
+// postOneClick sends the RFC 8058 one-click POST. The sender has received it when it
+// answers with a success or a redirect, any other status, a 405 included, is a failure.
+func (unsubscriber *CadUnsubscriber) postOneClick(target string) error {
+	resp, err := unsubscriber.Client.Post(target, "application/x-www-form-urlencoded", strings.NewReader(oneClickPostBody))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("unsubscribe POST to %s returned %s", target, resp.Status)
+	}
+	return nil
+}
+
+// sendMailto sends the mail described by an RFC 6068 mailto URI
+func (unsubscriber *CadUnsubscriber) sendMailto(target string) error {
+	uri, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	if uri.Opaque == "" {
+		return errors.New("mailto target without an address: " + target)
+	}
+
+	to, err := url.PathUnescape(uri.Opaque)
+	if err != nil {
+		return err
+	}
+	query := uri.Query()
+	subject := query.Get("subject")
+	if subject == "" {
+		subject = "unsubscribe"
+	}
+	text := query.Get("body")
+
+	// The target comes from the sender, line breaks would let it add headers
+	for _, value := range []string{to, subject, text} {
+		if strings.ContainsAny(value, "\r\n") {
+			return errors.New("mailto target with a line break: " + target)
+		}
+	}
+	addresses, err := mail.ParseAddressList(to)
+	if err != nil {
+		return fmt.Errorf("mailto target with an invalid address: %s: %v", target, err)
+	}
+	if len(addresses) != 1 {
+		return errors.New("mailto target with more than one address: " + target)
+	}
+
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "To: %s\r\n", addresses[0].String())
+	fmt.Fprintf(&body, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&body, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&body, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&body, "%s\r\n", text)
+
+	return unsubscriber.Send(body.Bytes())
+}
+
+func (unsubscriber *CadUnsubscriber) appendLog(record *CadUnsubscribeRecord) error {
+	records, err := ReadLocalUnsubscribes(unsubscriber.LogFile)
+	if err != nil {
+		return err
+	}
+	records = append(records, *record)
+
+	b, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		log.Printf("Unable to marshal unsubscribes to JSON: %v", err)
+		return err
+	}
+
+	err = ioutil.WriteFile(unsubscriber.LogFile, b, 0664)
+	if err != nil {
+		log.Printf("Unable to persist unsubscribes: %v", err)
+		return err
+	}
+	return nil
+}
+
+func ReadLocalUnsubscribes(filename string) ([]CadUnsubscribeRecord, error) {
+	if !fileExists(filename) {
+		return []CadUnsubscribeRecord{}, nil
+	}
+
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		log.Printf("Unable to read local unsubscribes file: %v", err)
+		return nil, err
+	}
+	var records []CadUnsubscribeRecord
+	if err := json.Unmarshal(b, &records); err != nil {
+		return []CadUnsubscribeRecord{}, err
+	}
+
+	return records, nil
+}
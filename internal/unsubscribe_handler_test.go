@@ -0,0 +1,154 @@
+package internal
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestUnsubscriber(t *testing.T, sent *[]string) *CadUnsubscriber {
+	unsubscriber := NewUnsubscriber(false)
+	unsubscriber.LogFile = filepath.Join(t.TempDir(), "unsubscribes.json")
+	unsubscriber.Send = func(raw []byte) error {
+		*sent = append(*sent, string(raw))
+		return nil
+	}
+	return unsubscriber
+}
+
+func TestUnsubscribeOneClick(t *testing.T) {
+	var method, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		method, body = r.Method, string(b)
+	}))
+	defer server.Close()
+
+	sent := []string{}
+	unsubscriber := newTestUnsubscriber(t, &sent)
+	record, err := unsubscriber.Unsubscribe("news@example.com", CadListUnsubscribe{HTTPS: []string{server.URL}, OneClick: true})
+	if err != nil {
+		t.Fatalf("Unsubscribe() error = %v", err)
+	}
+	if method != http.MethodPost || body != oneClickPostBody {
+		t.Errorf("got %s %q, want POST %q", method, body, oneClickPostBody)
+	}
+	if record.Method != UnsubscribeOneClick || record.Status != "sent" {
+		t.Errorf("got record %+v", record)
+	}
+
+	records, err := ReadLocalUnsubscribes(unsubscriber.LogFile)
+	if err != nil || len(records) != 1 {
+		t.Errorf("got %d logged unsubscribes, err %v, want 1", len(records), err)
+	}
+}
+
+func TestUnsubscribeMethodNotAllowed(t *testing.T) {
+	methods := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		if r.Method == http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	defer server.Close()
+
+	sent := []string{}
+	unsubscriber := newTestUnsubscriber(t, &sent)
+	if _, err := unsubscriber.Unsubscribe("news@example.com", CadListUnsubscribe{HTTPS: []string{server.URL}, OneClick: true}); err == nil {
+		t.Errorf("Unsubscribe() succeeded on a 405")
+	}
+	if strings.Join(methods, ",") != "POST" {
+		t.Errorf("got requests %v, want only the POST", methods)
+	}
+	records, err := ReadLocalUnsubscribes(unsubscriber.LogFile)
+	if err != nil || len(records) != 1 || records[0].Status != "failed" {
+		t.Errorf("got logged unsubscribes %+v, err %v, want one failed", records, err)
+	}
+}
+
+func TestUnsubscribeRedirectIsDelivered(t *testing.T) {
+	methods := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method+" "+r.URL.Path)
+		if r.URL.Path == "/unsubscribe" {
+			http.Redirect(w, r, "/landing", http.StatusFound)
+		}
+	}))
+	defer server.Close()
+
+	sent := []string{}
+	unsubscriber := newTestUnsubscriber(t, &sent)
+	record, err := unsubscriber.Unsubscribe("news@example.com", CadListUnsubscribe{HTTPS: []string{server.URL + "/unsubscribe"}, OneClick: true})
+	if err != nil {
+		t.Fatalf("Unsubscribe() error = %v", err)
+	}
+	if record.Status != "sent" {
+		t.Errorf("got record %+v", record)
+	}
+	if strings.Join(methods, ",") != "POST /unsubscribe" {
+		t.Errorf("got requests %v, want only the POST", methods)
+	}
+	records, err := ReadLocalUnsubscribes(unsubscriber.LogFile)
+	if err != nil || len(records) != 1 {
+		t.Errorf("got %d logged unsubscribes, err %v, want 1", len(records), err)
+	}
+}
+
+func TestUnsubscribeMailto(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:   "address only",
+			target: "mailto:leave@example.com",
+			want:   []string{"To: <leave@example.com>\r\n", "Subject: unsubscribe\r\n"},
+		},
+		{
+			name:   "subject and body",
+			target: "mailto:leave@example.com?subject=remove%20me&body=list%2042",
+			want:   []string{"To: <leave@example.com>\r\n", "Subject: remove me\r\n", "\r\n\r\nlist 42\r\n"},
+		},
+		{
+			name:   "non ascii subject is encoded",
+			target: "mailto:leave@example.com?subject=d%C3%A9sabonner",
+			want:   []string{"Subject: =?utf-8?q?d=C3=A9sabonner?=\r\n"},
+		},
+		{name: "CRLF in the address", target: "mailto:leave@example.com%0D%0ABcc:victim@example.com", wantErr: true},
+		{name: "CRLF in the subject", target: "mailto:leave@example.com?subject=x%0D%0ABcc:victim@example.com", wantErr: true},
+		{name: "LF in the body", target: "mailto:leave@example.com?body=x%0AFrom:%20boss@example.com", wantErr: true},
+		{name: "several addresses", target: "mailto:leave@example.com,victim@example.com", wantErr: true},
+		{name: "invalid address", target: "mailto:not%20an%20address", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent := []string{}
+			unsubscriber := newTestUnsubscriber(t, &sent)
+			_, err := unsubscriber.Unsubscribe("news@example.com", CadListUnsubscribe{Mailto: []string{tt.target}})
+			if tt.wantErr {
+				if err == nil || len(sent) > 0 {
+					t.Errorf("Unsubscribe() error = %v, sent %d mails, want an error and no mail", err, len(sent))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unsubscribe() error = %v", err)
+			}
+			if len(sent) != 1 {
+				t.Fatalf("sent %d mails, want 1", len(sent))
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(sent[0], want) {
+					t.Errorf("mail %q does not contain %q", sent[0], want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package internal
+
+import (
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Wording of unsubscribe, opt-out and preference links, lower case
+var unsubscribeKeywords = []string{
+	// English
+	"unsubscribe", "opt out", "opt-out", "optout", "manage preferences", "manage your preferences",
+	"email preferences", "update your preferences", "subscription preferences", "manage subscription",
+	"stop receiving", "remove me",
+	// French
+	"désabonner", "désabonnement", "désinscrire", "désinscription", "gérer vos préférences",
+	// German
+	"abmelden", "abbestellen", "austragen", "abmeldung", "einstellungen verwalten",
+	// Spanish
+	"darse de baja", "darte de baja", "cancelar suscripción", "cancelar la suscripción", "anular suscripción",
+	// Italian
+	"annulla iscrizione", "disiscriviti", "cancella iscrizione", "gestisci le preferenze",
+	// Portuguese
+	"descadastrar", "cancelar inscrição", "cancelar assinatura", "gerenciar preferências",
+	// Dutch
+	"afmelden", "uitschrijven",
+	// Scandinavian
+	"avregistrera", "avsluta prenumeration", "afmeld", "meld deg av",
+	// Polish
+	"wypisz się", "zrezygnuj z subskrypcji",
+}
+
+// Keywords which mark a link as an unsubscribe link when found in the URL itself
+var unsubscribeUrlKeywords = []string{"unsubscribe", "optout", "opt-out", "opt_out", "preferences"}
+
+// Text read before an anchor that can introduce it, as in "To unsubscribe, click here"
+const anchorContextLength int = 80
+
+var regTextUrl = regexp.MustCompile(`https?://[^\s<>"')\]]+`)
+
+// ExtractUnsubscribeLinks returns the unsubscribe URLs found in the HTML parts, then in
+// the plain text parts of a message, without duplicates
+func ExtractUnsubscribeLinks(content *CadMessageContent) []string {
+	links := []string{}
+	seen := map[string]bool{}
+	add := func(found []string) {
+		for _, link := range found {
+			if !seen[link] {
+				seen[link] = true
+				links = append(links, link)
+			}
+		}
+	}
+
+	for _, document := range content.HTML {
+		add(htmlUnsubscribeLinks(document))
+	}
+	for _, text := range content.Text {
+		add(textUnsubscribeLinks(text))
+	}
+	return links
+}
+
+// htmlUnsubscribeLinks tokenizes an HTML document and returns the href of every anchor
+// whose text, title, URL or preceding text mentions unsubscribing
+func htmlUnsubscribeLinks(document string) []string {
+	links := []string{}
+	tokenizer := html.NewTokenizer(strings.NewReader(document))
+
+	inAnchor := false
+	href := ""
+	anchorText := ""
+	precedingText := ""
+	for {
+		tokenType := tokenizer.Next()
+		switch tokenType {
+		case html.ErrorToken:
+			// io.EOF at the end of the document, otherwise the links found so far
+			return links
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			if token.Data != "a" {
+				continue
+			}
+			inAnchor = true
+			href = ""
+			anchorText = ""
+			for _, attr := range token.Attr {
+				switch strings.ToLower(attr.Key) {
+				case "href":
+					href = strings.TrimSpace(attr.Val)
+				case "title", "aria-label":
+					anchorText += " " + attr.Val
+				}
+			}
+		case html.TextToken:
+			text := string(tokenizer.Text())
+			if inAnchor {
+				anchorText += " " + text
+			} else {
+				precedingText = lastRunes(precedingText+" "+text, anchorContextLength)
+			}
+		case html.EndTagToken:
+			token := tokenizer.Token()
+			if token.Data != "a" || !inAnchor {
+				continue
+			}
+			inAnchor = false
+			if !isLinkTarget(href) {
+				continue
+			}
+			if containsKeyword(anchorText, unsubscribeKeywords) ||
+				containsKeyword(href, unsubscribeUrlKeywords) ||
+				containsKeyword(precedingText, unsubscribeKeywords) {
+				links = append(links, href)
+			}
+			precedingText = ""
+		}
+	}
+}
+
+// textUnsubscribeLinks returns the URLs in a plain text part which mention unsubscribing
+// themselves, sit on a line that does, or follow a line without links that does,
+// as in "To unsubscribe visit:"
+func textUnsubscribeLinks(text string) []string {
+	links := []string{}
+	previousLine := ""
+	for _, line := range strings.Split(text, "\n") {
+		introduced := containsKeyword(previousLine, unsubscribeKeywords) && !regTextUrl.MatchString(previousLine)
+		lineMentions := introduced || containsKeyword(line, unsubscribeKeywords)
+		for _, link := range regTextUrl.FindAllString(line, -1) {
+			link = strings.TrimRight(link, ".,;:")
+			if lineMentions || containsKeyword(link, unsubscribeUrlKeywords) {
+				links = append(links, link)
+			}
+		}
+		if strings.TrimSpace(line) != "" {
+			previousLine = line
+		}
+	}
+	return links
+}
+
+func containsKeyword(text string, keywords []string) bool {
+	text = strings.ToLower(strings.Join(strings.Fields(text), " "))
+	for _, keyword := range keywords {
+		if strings.Contains(text, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+func isLinkTarget(href string) bool {
+	lower := strings.ToLower(href)
+	return strings.HasPrefix(lower, "http://") ||
+		strings.HasPrefix(lower, "https://") ||
+		strings.HasPrefix(lower, "mailto:")
+}
+
+func lastRunes(text string, n int) string {
+	runes := []rune(text)
+	if len(runes) <= n {
+		return text
+	}
+	return string(runes[len(runes)-n:])
+}
@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHtmlUnsubscribeLinks(t *testing.T) {
+	tests := []struct {
+		name     string
+		document string
+		want     []string
+	}{
+		{
+			name:     "anchor text",
+			document: `<p><a href="https://x.com/u?id=1">Unsubscribe</a> <a href="https://x.com/shop">Shop</a></p>`,
+			want:     []string{"https://x.com/u?id=1"},
+		},
+		{
+			name:     "french anchor",
+			document: `<a href="https://x.fr/l/1">Se <b>désabonner</b></a>`,
+			want:     []string{"https://x.fr/l/1"},
+		},
+		{
+			name:     "german anchor",
+			document: `<a href="https://x.de/l/2">Newsletter ABMELDEN</a>`,
+			want:     []string{"https://x.de/l/2"},
+		},
+		{
+			name:     "spanish anchor across lines",
+			document: "<a href=\"https://x.es/l/3\">darse\n  de baja</a>",
+			want:     []string{"https://x.es/l/3"},
+		},
+		{
+			name:     "title attribute",
+			document: `<a href="https://x.com/l/4" title="Manage preferences"><img src="gear.png"></a>`,
+			want:     []string{"https://x.com/l/4"},
+		},
+		{
+			name:     "keyword in the url",
+			document: `<a href="https://x.com/opt-out?u=1">here</a>`,
+			want:     []string{"https://x.com/opt-out?u=1"},
+		},
+		{
+			name:     "preceding text",
+			document: `<p>To unsubscribe from these emails, <a href="https://x.com/l/5">click here</a>. <a href="https://x.com/l/6">View online</a></p>`,
+			want:     []string{"https://x.com/l/5"},
+		},
+		{
+			name:     "mailto",
+			document: `<a href="mailto:leave@x.com?subject=unsubscribe">Unsubscribe by email</a>`,
+			want:     []string{"mailto:leave@x.com?subject=unsubscribe"},
+		},
+		{
+			name:     "relative and javascript links are ignored",
+			document: `<a href="/unsubscribe">Unsubscribe</a><a href="javascript:void(0)">Unsubscribe</a>`,
+			want:     []string{},
+		},
+		{
+			name:     "no unsubscribe link",
+			document: `<a href="https://x.com/shop">Shop now</a>`,
+			want:     []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := htmlUnsubscribeLinks(tt.document); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("htmlUnsubscribeLinks() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTextUnsubscribeLinks(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []string
+	}{
+		{
+			name: "same line",
+			text: "Unsubscribe: https://x.com/l/1.",
+			want: []string{"https://x.com/l/1"},
+		},
+		{
+			name: "introduced by the previous line",
+			text: "To unsubscribe visit:\n\nhttps://x.com/l/2\nhttps://x.com/shop",
+			want: []string{"https://x.com/l/2"},
+		},
+		{
+			name: "previous line with its own link",
+			text: "Unsubscribe at https://x.com/l/3\nhttps://x.com/shop",
+			want: []string{"https://x.com/l/3"},
+		},
+		{
+			name: "localized line",
+			text: "Pour vous désinscrire, rendez-vous sur https://x.fr/l/4",
+			want: []string{"https://x.fr/l/4"},
+		},
+		{
+			name: "keyword in the url",
+			text: "Read more https://x.com/blog\nSettings (https://x.com/preferences?u=1)",
+			want: []string{"https://x.com/preferences?u=1"},
+		},
+		{
+			name: "no unsubscribe link",
+			text: "Shop now at https://x.com/shop",
+			want: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := textUnsubscribeLinks(tt.text); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("textUnsubscribeLinks() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractUnsubscribeLinks(t *testing.T) {
+	content := &CadMessageContent{
+		HTML: []string{`<a href="https://x.com/l/1">Unsubscribe</a>`},
+		Text: []string{"Unsubscribe: https://x.com/l/1\nOpt out: https://x.com/l/2"},
+	}
+	want := []string{"https://x.com/l/1", "https://x.com/l/2"}
+	if got := ExtractUnsubscribeLinks(content); !reflect.DeepEqual(got, want) {
+		t.Errorf("ExtractUnsubscribeLinks() = %q, want %q", got, want)
+	}
+}